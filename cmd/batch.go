@@ -0,0 +1,299 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"spaceship/pkg"
+
+	"github.com/schollz/progressbar/v3"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	batchStatusSuccess = "success"
+	batchStatusFailure = "failure"
+)
+
+// one line of a transfer manifest, also one item of the result report
+type batchEntry struct {
+	Src string `json:"src" yaml:"src"`
+	// optional, default is decided by command
+	Dst string `json:"dst,omitempty" yaml:"dst,omitempty"`
+	// extra request headers like "Referer: https://example.com", only used by fetch
+	Header []string `json:"header,omitempty" yaml:"header,omitempty"`
+	// filled in report
+	Status   string `json:"status,omitempty" yaml:"status,omitempty"`
+	Error    string `json:"error,omitempty" yaml:"error,omitempty"`
+	Attempts int    `json:"attempts,omitempty" yaml:"attempts,omitempty"`
+	Size     int64  `json:"size,omitempty" yaml:"size,omitempty"`
+	Duration string `json:"duration,omitempty" yaml:"duration,omitempty"`
+}
+
+// split a manifest line by whitespace, double quotes can be used to keep spaces
+func splitManifestLine(line string) ([]string, error) {
+	var fields []string
+	var buf strings.Builder
+	quoted, hasField := false, false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '"':
+			quoted = !quoted
+			hasField = true
+		case c == '\\' && quoted && i+1 < len(line) && (line[i+1] == '"' || line[i+1] == '\\'):
+			i++
+			buf.WriteByte(line[i])
+		case !quoted && (c == ' ' || c == '\t'):
+			if hasField {
+				fields = append(fields, buf.String())
+				buf.Reset()
+				hasField = false
+			}
+		default:
+			buf.WriteByte(c)
+			hasField = true
+		}
+	}
+	if quoted {
+		return nil, errors.New("unclosed quote")
+	}
+	if hasField {
+		fields = append(fields, buf.String())
+	}
+	return fields, nil
+}
+
+// options of a manifest line, key is case insensitive
+func setManifestOption(entry *batchEntry, field string) bool {
+	index := strings.Index(field, "=")
+	if index < 0 {
+		return false
+	}
+	switch strings.ToLower(field[:index]) {
+	case "out", "dst":
+		entry.Dst = field[index+1:]
+	case "header":
+		entry.Header = append(entry.Header, field[index+1:])
+	default:
+		return false
+	}
+	return true
+}
+
+// load manifest, supports JSON list, YAML list and lines of "src [dst] [out=<dst>] [header=<header>]..."
+//
+// an indented line following an entry adds one option to it, eg. "  header=Referer: https://example.com",
+// a report can be loaded as a manifest, entries whose status is success will be skipped by runBatch
+func loadManifest(name string) ([]*batchEntry, error) {
+	bs, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*batchEntry
+	trimmed := bytes.TrimSpace(bs)
+	switch ext := strings.ToLower(filepath.Ext(name)); {
+	case ext == ".json" || bytes.HasPrefix(trimmed, []byte("[")):
+		if err := json.Unmarshal(trimmed, &entries); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", name, err)
+		}
+	case ext == ".yaml" || ext == ".yml" || bytes.HasPrefix(trimmed, []byte("- ")):
+		if err := yaml.Unmarshal(trimmed, &entries); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", name, err)
+		}
+	default:
+		scanner := bufio.NewScanner(bytes.NewReader(bs))
+		lineNo := 0
+		for scanner.Scan() {
+			lineNo++
+			raw := scanner.Text()
+			line := strings.TrimSpace(raw)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			var entry *batchEntry
+			var fields []string
+			indented := raw[0] == ' ' || raw[0] == '\t'
+			if indented && len(entries) > 0 {
+				// one option per indented line, so spaces in value need no quotes
+				entry = entries[len(entries)-1]
+				fields = []string{line}
+			} else {
+				var err error
+				if fields, err = splitManifestLine(line); err != nil {
+					return nil, fmt.Errorf("%s:%d: %w", name, lineNo, err)
+				}
+				entry = &batchEntry{Src: fields[0]}
+				fields = fields[1:]
+				entries = append(entries, entry)
+			}
+			hasDst := entry.Dst != ""
+			for _, field := range fields {
+				if setManifestOption(entry, field) {
+					continue
+				}
+				if hasDst || indented {
+					return nil, fmt.Errorf("%s:%d: unexpected field %s, require <src> <dst?> or options like out=<dst> header=<header>", name, lineNo, field)
+				}
+				entry.Dst = field
+				hasDst = true
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	for i, entry := range entries {
+		if entry == nil || strings.TrimSpace(entry.Src) == "" {
+			return nil, fmt.Errorf("%s: item %d has empty src", name, i+1)
+		}
+		if entry.Status != batchStatusSuccess {
+			entry.Status, entry.Error, entry.Attempts, entry.Duration = "", "", 0, ""
+		}
+	}
+	return entries, nil
+}
+
+// write report as JSON, or YAML if extension is .yaml or .yml
+func writeBatchReport(name string, entries []*batchEntry) error {
+	var bs []byte
+	var err error
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		bs, err = yaml.Marshal(entries)
+	default:
+		bs, err = json.MarshalIndent(entries, "", "  ")
+		bs = append(bs, '\n')
+	}
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, bs, 0644)
+}
+
+type batchOption struct {
+	// number of files transferred at the same time
+	Jobs int
+	// retry times of one file after the first failure
+	Retry int
+	// do transfers one entry, it will be called again if it returns an error and retry is left
+	Do func(entry *batchEntry) error
+	// aggregate progress bar, optional, it will be cleared before printing status of a file
+	Bar *progressbar.ProgressBar
+}
+
+// run all entries with limited concurrency, return count of failures
+func runBatch(entries []*batchEntry, option batchOption) int {
+	if option.Jobs <= 0 {
+		option.Jobs = 1
+	}
+	if option.Retry < 0 {
+		option.Retry = 0
+	}
+	var failures int64
+	var l sync.Mutex
+	// print status line without breaking the progress bar
+	printStatus := func(f func()) {
+		l.Lock()
+		defer l.Unlock()
+		if option.Bar != nil {
+			option.Bar.Clear()
+		}
+		f()
+	}
+	var wg sync.WaitGroup
+	ch := make(chan struct{}, option.Jobs)
+	for _, entry := range entries {
+		if entry.Status == batchStatusSuccess {
+			logger.Debugf("skip %s because it succeeded in previous report", entry.Src)
+			continue
+		}
+		wg.Add(1)
+		ch <- struct{}{}
+		go func(entry *batchEntry) {
+			defer func() {
+				wg.Done()
+				<-ch
+			}()
+			start := time.Now()
+			var err error
+			for entry.Attempts = 1; entry.Attempts <= option.Retry+1; entry.Attempts++ {
+				if err = option.Do(entry); err == nil {
+					break
+				}
+				if entry.Attempts <= option.Retry {
+					printStatus(func() {
+						logger.Warnf("%s failed (attempt %d/%d): %s", entry.Src, entry.Attempts, option.Retry+1, err)
+					})
+					time.Sleep(time.Second * time.Duration(entry.Attempts))
+				}
+			}
+			if entry.Attempts > option.Retry+1 {
+				entry.Attempts = option.Retry + 1
+			}
+			entry.Duration = time.Since(start).Round(time.Millisecond).String()
+			printStatus(func() {
+				if err != nil {
+					atomic.AddInt64(&failures, 1)
+					entry.Status = batchStatusFailure
+					entry.Error = err.Error()
+					logger.Errorf("%s %s: %s", logger.Red("[failure]"), entry.Src, err)
+				} else {
+					entry.Status = batchStatusSuccess
+					logger.Infof("%s %s => %s  %s  %s", logger.Green("[success]"), entry.Src, entry.Dst, formatBatchSize(entry.Size), entry.Duration)
+				}
+			})
+		}(entry)
+	}
+	wg.Wait()
+	return int(failures)
+}
+
+func formatBatchSize(size int64) string {
+	if size < 0 {
+		return "unknown size"
+	}
+	return pkg.FormatSize(size)
+}
+
+// finish batch: write report and exit with non-zero status if any failures,
+// manifestFlag is the flag to load manifest, it is used in the hint of retrying failures
+func finishBatch(entries []*batchEntry, failures int, report string, manifestFlag string) {
+	if report != "" {
+		if err := writeBatchReport(report, entries); err != nil {
+			logger.Errorln("write report failed:", err)
+		} else {
+			logger.Infof("report written to %s", report)
+		}
+	}
+	if failures > 0 {
+		if report != "" {
+			logger.Fatalf("%d of %d files failed, rerun with --%s %s to retry failures", failures, len(entries), manifestFlag, report)
+		}
+		logger.Fatalf("%d of %d files failed", failures, len(entries))
+	}
+	logger.Infof("all %d files transferred", len(entries))
+}
+
+// add flag "from-file" "jobs" "retry" "report"
+func addBatchFlags(cmd *cobra.Command) {
+	cmd.Flags().String("from-file", "", "transfer files listed in manifest, lines of \"<src> <dst?>\" or JSON/YAML list of {src, dst}")
+	addBatchRunFlags(cmd, "from-file")
+}
+
+// add flag "jobs" "retry" "report", manifestFlag is the flag to load manifest
+func addBatchRunFlags(cmd *cobra.Command, manifestFlag string) {
+	cmd.Flags().IntP("jobs", "j", 3, "number of files transferred at the same time when using --"+manifestFlag)
+	cmd.Flags().Int("retry", 2, "retry times of a failed file when using --"+manifestFlag)
+	cmd.Flags().String("report", "", "write result report when using --"+manifestFlag+", it can be used as manifest to retry failures")
+}
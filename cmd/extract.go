@@ -0,0 +1,879 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"spaceship/pkg"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/spf13/cobra"
+	"github.com/ulikunitz/xz"
+)
+
+// default regexp of paths not to extract
+const defaultExtractExclude = `node_modules|__pycache__|venv|\.git`
+
+// format of archive detected by magic bytes
+type archiveFormat int
+
+const (
+	formatUnknown archiveFormat = iota
+	formatTar
+	formatTarGzip
+	formatTarZstd
+	formatTarXz
+	formatZip
+)
+
+func (f archiveFormat) String() string {
+	switch f {
+	case formatTar:
+		return "tar"
+	case formatTarGzip:
+		return "tar.gz"
+	case formatTarZstd:
+		return "tar.zst"
+	case formatTarXz:
+		return "tar.xz"
+	case formatZip:
+		return "zip"
+	}
+	return "unknown"
+}
+
+// bytes required to detect format, magic of tar is at offset 257
+const archiveHeadSize = 262
+
+// detect format by the first bytes of archive, compressed content is assumed to be tar
+func detectArchive(head []byte) archiveFormat {
+	switch {
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return formatTarGzip
+	case bytes.HasPrefix(head, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return formatTarZstd
+	case bytes.HasPrefix(head, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return formatTarXz
+	// an empty zip has only the end of central directory
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return formatZip
+	case len(head) >= archiveHeadSize && string(head[257:archiveHeadSize]) == "ustar":
+		return formatTar
+	}
+	return formatUnknown
+}
+
+// policies of symlink entries
+const (
+	// symlinks are not created
+	symlinksSkip = "skip"
+	// symlinks are created as they are, entries are still never written through a symlink out of root
+	symlinksKeep = "keep"
+	// symlinks are created only if they point into root
+	symlinksFollowInside = "follow-inside"
+)
+
+// extracts entries of archive under root, it is shared by unzip and --extract of fetch and get.
+//
+// Entries are never written out of root, leading "/" and drive letters are stripped from names, names escaping
+// root by ".." are rejected, and so are paths passing through a symlink out of root.
+// Total size and number of extracted entries are limited to defuse zip bombs.
+type extractor struct {
+	root string
+	// root with symlinks evaluated
+	realRoot  string
+	overwrite bool
+	// nil if all entries are extracted
+	exclude *regexp.Regexp
+	// print every entry, otherwise entries are logged at debug level
+	verbose  bool
+	symlinks string
+	// limits of total size and number of entries, 0 means unlimited
+	maxSize    int64
+	maxEntries int
+	size       int64
+	entries    int
+	// restore uid and gid of tar entries
+	sameOwner bool
+	// directories extracted from tar, their modes and times are restored at last
+	dirs []extractedDir
+	// password of encrypted zip entries, it is asked from terminal when the first one is met if it is empty
+	password string
+	// charset of zip entry names without UTF-8 flag, it is detected if empty
+	charset string
+	// glob patterns of entries to extract, all entries are extracted if empty
+	include []string
+	// number of leading path components stripped from names
+	stripComponents int
+	// entries are verified without writing
+	test bool
+	// content of extracted or verified entries is also written to it if not nil, for example, a progress bar
+	progress io.Writer
+}
+
+// directory whose attributes are restored at last, header is nil for zip whose directories have only times
+type extractedDir struct {
+	path    string
+	header  *tar.Header
+	modTime time.Time
+}
+
+// create extractor by flag "overwrite" "exclude" "all" and flags of addExtractPolicyFlags, root must be an existing directory
+func newExtractorByFlags(cmd *cobra.Command, root string) *extractor {
+	all, _ := cmd.Flags().GetBool("all")
+	overwrite, _ := cmd.Flags().GetBool("overwrite")
+	rule, _ := cmd.Flags().GetString("exclude")
+	symlinks, _ := cmd.Flags().GetString("symlinks")
+	maxEntries, _ := cmd.Flags().GetInt("max-entries")
+	sameOwner, _ := cmd.Flags().GetBool("same-owner")
+	charset, _ := cmd.Flags().GetString("charset")
+	stripComponents, _ := cmd.Flags().GetInt("strip-components")
+	maxSize := getRateFlag(cmd, "max-size")
+	excludeRegexp, err := regexp.Compile(rule)
+	if err != nil {
+		logger.Fatalln(err)
+	}
+	switch symlinks {
+	case symlinksSkip, symlinksKeep, symlinksFollowInside:
+	default:
+		logger.Fatalf("invalid --symlinks %s, it should be skip, keep or follow-inside", symlinks)
+	}
+	root = path.Clean(strings.ReplaceAll(root, `\`, `/`))
+	if info, err := os.Stat(root); err != nil {
+		logger.Fatalln(err)
+	} else if !info.IsDir() {
+		logger.Fatalln(root, " is not a directory")
+	}
+	realRoot, err := realPath(root)
+	if err != nil {
+		logger.Fatalln(err)
+	}
+	e := &extractor{
+		root:       root,
+		realRoot:   realRoot,
+		overwrite:  overwrite,
+		symlinks:   symlinks,
+		maxSize:    maxSize,
+		maxEntries: maxEntries,
+		sameOwner:  sameOwner,
+		charset:    charset,
+	}
+	if stripComponents < 0 {
+		logger.Fatalln("--strip-components must not be negative")
+	}
+	e.stripComponents = stripComponents
+	if all {
+		logger.Debugln("unarchive all files, the regexp to exclude was ignored")
+	} else {
+		logger.Debugln("regexp to exclude:", excludeRegexp.String())
+		e.exclude = excludeRegexp
+	}
+	if cmd.Flags().Lookup("password") != nil {
+		e.password = passwordOfFlags(cmd)
+	}
+	logger.Debugf("symlinks: %s  max size: %d  max entries: %d", symlinks, maxSize, maxEntries)
+	return e
+}
+
+// add flag "extract" "exclude" "all" and flags of addExtractPolicyFlags to extract the downloaded archive
+func addExtractFlags(cmd *cobra.Command) {
+	cmd.Flags().String("extract", "", "extract the downloaded tar, tar.gz, tar.zst, tar.xz or zip to the directory instead of saving it, tar is extracted during download")
+	cmd.Flags().String("exclude", defaultExtractExclude, "specify regexp to exclude files when using --extract, first match the basename, then match the archive path")
+	cmd.Flags().Bool("all", false, "extract all files when using --extract, the regexp to exclude files will be ignored")
+	addExtractPolicyFlags(cmd)
+}
+
+// add flag "symlinks" "max-size" "max-entries" "same-owner" "charset" "strip-components"
+func addExtractPolicyFlags(cmd *cobra.Command) {
+	cmd.Flags().Bool("same-owner", false, "restore uid and gid of tar entries, it usually requires root")
+	cmd.Flags().String("symlinks", symlinksSkip, "how to extract symlinks, skip, keep, or follow-inside to keep only symlinks pointing into the directory")
+	cmd.Flags().String("max-size", "100G", "maximum total size of extracted files, eg. 500M 10G, 0 means unlimited")
+	cmd.Flags().Int("max-entries", 1000000, "maximum number of extracted entries, 0 means unlimited")
+	cmd.Flags().String("charset", "", "charset of zip entry names without UTF-8 flag, eg. gbk shift_jis cp437, it is detected if omitted")
+	cmd.Flags().Int("strip-components", 0, "strip number of leading components from entry names, entries with fewer components are skipped")
+}
+
+// absolute path with symlinks evaluated
+func realPath(p string) (string, error) {
+	p, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(p)
+}
+
+// whether p is root or under it, both are cleaned absolute paths
+func within(root string, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// local path of entry name, leading "/" and drive letter like "C:" are stripped, names escaping root are rejected,
+// empty if the name has no component left after stripComponents
+func (e *extractor) target(name string) (string, error) {
+	p := strings.ReplaceAll(name, `\`, `/`)
+	if len(p) >= 2 && p[1] == ':' && ('a' <= p[0] && p[0] <= 'z' || 'A' <= p[0] && p[0] <= 'Z') {
+		p = p[2:]
+	}
+	if trimmed := strings.TrimLeft(p, "/"); trimmed != p {
+		logger.Warnf("absolute path %s is extracted as %s", name, trimmed)
+		p = trimmed
+	}
+	p = path.Clean(p)
+	if p == ".." || strings.HasPrefix(p, "../") {
+		return "", fmt.Errorf("%s is out of %s, the archive may be malicious", name, e.root)
+	}
+	if e.stripComponents > 0 {
+		parts := strings.Split(p, "/")
+		if len(parts) <= e.stripComponents {
+			return "", nil
+		}
+		p = path.Join(parts[e.stripComponents:]...)
+	}
+	return path.Join(e.root, p), nil
+}
+
+// local path of entry name to extract, empty if it isn't selected by include patterns, regexp to exclude
+// or stripComponents
+func (e *extractor) selected(name string) (string, error) {
+	p, err := e.target(name)
+	if err != nil || p == "" || !e.included(name) {
+		return "", err
+	}
+	if e.matchExclude(p) {
+		logger.Warnln("skip", p, "because it matched regexp to exclude")
+		return "", nil
+	}
+	return p, nil
+}
+
+func (e *extractor) matchExclude(p string) bool {
+	return e.exclude != nil && (e.exclude.MatchString(p) || e.exclude.MatchString(path.Base(p)))
+}
+
+func (e *extractor) included(name string) bool {
+	return matchInclude(e.include, name)
+}
+
+// whether entry name matches one of patterns, or is under a directory matching one, true if there is no pattern
+func matchInclude(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	name = strings.Trim(path.Clean("/"+strings.ReplaceAll(name, `\`, "/")), "/")
+	for _, pattern := range patterns {
+		for i := 0; i <= len(name); i++ {
+			if (i == len(name) || name[i] == '/') && matchGlob(pattern, name[:i]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// match slash-separated name by pattern of path.Match, "**" matches zero or more directories
+func matchGlob(pattern string, name string) bool {
+	return matchGlobParts(strings.Split(strings.Trim(pattern, "/"), "/"), strings.Split(name, "/"))
+}
+
+func matchGlobParts(pattern []string, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			pattern = pattern[1:]
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := range name {
+				if matchGlobParts(pattern, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// count an entry of size against limits before it is extracted
+func (e *extractor) count(p string, size int64) error {
+	e.entries++
+	if e.maxEntries > 0 && e.entries > e.maxEntries {
+		return fmt.Errorf("archive has more than %d entries, use --max-entries to raise the limit", e.maxEntries)
+	}
+	if e.maxSize > 0 && e.size+size > e.maxSize {
+		return fmt.Errorf("total size exceeds %s at %s, use --max-size to raise the limit", pkg.FormatSize(e.maxSize), p)
+	}
+	return nil
+}
+
+// sizes in headers may be forged, so the limit is also checked while copying
+func (e *extractor) copy(w io.Writer, r io.Reader, p string) error {
+	if e.progress != nil {
+		w = io.MultiWriter(w, e.progress)
+	}
+	if e.maxSize > 0 && !e.test {
+		r = io.LimitReader(r, e.maxSize-e.size+1)
+	}
+	n, err := io.Copy(w, r)
+	e.size += n
+	if err == nil && e.maxSize > 0 && e.size > e.maxSize && !e.test {
+		return fmt.Errorf("total size exceeds %s at %s, use --max-size to raise the limit", pkg.FormatSize(e.maxSize), p)
+	}
+	return err
+}
+
+// check that p is not written through a symlink out of root, the nearest existing parent of p is evaluated,
+// missing parents created later are inside it
+func (e *extractor) checkParent(p string) error {
+	dir := filepath.Dir(p)
+	for {
+		if _, err := os.Lstat(dir); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		dir = filepath.Dir(dir)
+	}
+	real, err := realPath(dir)
+	if err != nil {
+		return err
+	}
+	if !within(e.realRoot, real) {
+		return fmt.Errorf("%s is out of %s through a symlink, the archive may be malicious", p, e.root)
+	}
+	return nil
+}
+
+// check existing file at p before an entry is extracted to it, returns whether it is a directory to keep,
+// an existing symlink is removed if it is overwritten, so nothing is written through it
+func (e *extractor) checkExisting(p string, isDir bool) (bool, error) {
+	info, err := os.Lstat(p)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if info.Mode()&fs.ModeSymlink != 0 && isDir {
+		// a symlink to a directory inside root can be kept as the directory
+		if real, err := realPath(p); err == nil && within(e.realRoot, real) {
+			if info, err := os.Stat(real); err == nil && info.IsDir() {
+				return true, nil
+			}
+		}
+	}
+	if info.IsDir() {
+		if !isDir {
+			return false, fmt.Errorf("%s is a directory, you should delete it manually", p)
+		}
+		return true, nil
+	}
+	if !e.overwrite {
+		return false, fmt.Errorf("%s already exists, you should use --overwrite", p)
+	}
+	if info.Mode()&fs.ModeSymlink != 0 || isDir {
+		return false, os.Remove(p)
+	}
+	return false, nil
+}
+
+// extract an entry to p, open is not called for directories
+func (e *extractor) extract(p string, mode fs.FileMode, size int64, open func() (io.ReadCloser, error)) error {
+	if e.verbose && pkg.GetLogLevel() <= pkg.LINFO {
+		fmt.Printf("%s\t%s\t%s\n", mode, pkg.FormatSize(size, concat), p)
+	} else {
+		logger.Debugln("extract", p)
+	}
+	if e.test {
+		return e.verify(p, mode, open)
+	}
+	if err := e.count(p, size); err != nil {
+		return err
+	}
+	if err := e.checkParent(p); err != nil {
+		return err
+	}
+	existDir, err := e.checkExisting(p, mode.IsDir())
+	if err != nil {
+		return err
+	}
+	if mode.IsDir() {
+		if existDir {
+			return nil
+		}
+		return os.MkdirAll(p, mode.Perm()|0700)
+	}
+	// parent directories may be absent from archive
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		return err
+	}
+	fr, err := open()
+	if err != nil {
+		return err
+	}
+	defer fr.Close()
+	fw, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	err = e.copy(fw, fr, p)
+	if closeErr := fw.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(p)
+	}
+	return err
+}
+
+// read an entry to verify its checksum, nothing is written
+func (e *extractor) verify(p string, mode fs.FileMode, open func() (io.ReadCloser, error)) error {
+	e.entries++
+	if mode.IsDir() {
+		return nil
+	}
+	r, err := open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return e.copy(io.Discard, r, p)
+}
+
+// password of encrypted entries
+func (e *extractor) getPassword() (string, error) {
+	if e.password == "" {
+		password, err := readPassword("Please input password of archive: ", false)
+		if err != nil {
+			return "", err
+		}
+		e.password = password
+	}
+	return e.password, nil
+}
+
+// create symlink p pointing to target by the policy
+func (e *extractor) symlink(p string, target string) error {
+	if e.test {
+		e.entries++
+		return nil
+	}
+	if e.symlinks == symlinksSkip {
+		logger.Warnln("skip symlink", p, "->", target, "because --symlinks is skip")
+		return nil
+	}
+	logger.Debugln("symlink", p, "->", target)
+	if err := e.count(p, 0); err != nil {
+		return err
+	}
+	if err := e.checkParent(p); err != nil {
+		return err
+	}
+	if e.symlinks == symlinksFollowInside && !e.pointsInside(p, target) {
+		logger.Warnln("skip symlink", p, "->", target, "because it points out of", e.root)
+		return nil
+	}
+	if _, err := e.checkExisting(p, false); err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		return err
+	}
+	return os.Symlink(target, p)
+}
+
+// whether symlink p to target resolves inside root, the parent of p has been checked by checkParent
+func (e *extractor) pointsInside(p string, target string) bool {
+	target = filepath.FromSlash(target)
+	if filepath.IsAbs(target) || filepath.VolumeName(target) != "" {
+		return false
+	}
+	parent, err := filepath.Abs(filepath.Dir(p))
+	if err != nil {
+		return false
+	}
+	// parents of p may not exist yet, they are under root, so the path is resolved by the real root
+	rel, err := filepath.Rel(e.root, parent)
+	if err != nil {
+		return false
+	}
+	resolved := filepath.Join(e.realRoot, rel, target)
+	if !within(e.realRoot, resolved) {
+		return false
+	}
+	// a symlink already extracted may lead out of root
+	if real, err := filepath.EvalSymlinks(resolved); err == nil {
+		return within(e.realRoot, real)
+	}
+	return true
+}
+
+// create hard link p to entry name extracted before
+func (e *extractor) link(p string, name string) error {
+	if e.test {
+		e.entries++
+		return nil
+	}
+	old, err := e.target(name)
+	if err != nil {
+		return err
+	}
+	if old == "" {
+		return fmt.Errorf("target %s of link %s is stripped by --strip-components", name, p)
+	}
+	logger.Debugln("link", p, "=>", old)
+	if err := e.count(p, 0); err != nil {
+		return err
+	}
+	if err := e.checkParent(p); err != nil {
+		return err
+	}
+	if err := e.checkParent(old); err != nil {
+		return err
+	}
+	if _, err := e.checkExisting(p, false); err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		return err
+	}
+	return os.Link(old, p)
+}
+
+// entries failed by wrong password are reported and skipped, others are extracted
+func (e *extractor) extractZip(r *zip.Reader) error {
+	if err := decodeZipNames(r, e.charset); err != nil {
+		return err
+	}
+	failed := 0
+	for _, f := range r.File {
+		p, err := e.selected(f.Name)
+		if err != nil {
+			return err
+		}
+		if p == "" {
+			continue
+		}
+		if f.Mode()&fs.ModeSymlink != 0 {
+			var target string
+			if target, err = e.readZipSymlink(f); err == nil {
+				err = e.symlink(p, target)
+			}
+		} else {
+			err = e.extract(p, f.Mode(), int64(f.UncompressedSize64), func() (io.ReadCloser, error) {
+				return openZipEntry(f, e.getPassword)
+			})
+			if err == nil && !e.test {
+				err = e.restoreZipTime(p, f)
+			}
+		}
+		// every entry is verified even if some are corrupt
+		if errors.Is(err, errWrongPassword) || (err != nil && e.test) {
+			action := "extract"
+			if e.test {
+				action = "verify"
+			}
+			logger.Errorf("%s %s failed: %s", action, f.Name, err)
+			failed++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := e.restoreDirs(); err != nil {
+		return err
+	}
+	if failed > 0 && e.test {
+		return fmt.Errorf("%d of %d entries are corrupt or can't be decrypted", failed, e.entries)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d encrypted entries are not extracted", failed)
+	}
+	return nil
+}
+
+// target of symlink is the content of entry
+func (e *extractor) readZipSymlink(f *zip.File) (string, error) {
+	r, err := openZipEntry(f, e.getPassword)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	bs, err := io.ReadAll(io.LimitReader(r, 4096))
+	return string(bs), err
+}
+
+// reader of tar decompressed from r by format, close must be called after read
+func decompressTar(format archiveFormat, r io.Reader) (io.Reader, func(), error) {
+	switch format {
+	case formatTarGzip:
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return gr, func() { gr.Close() }, nil
+	case formatTarZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, zr.Close, nil
+	case formatTarXz:
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return xr, func() {}, nil
+	}
+	return r, func() {}, nil
+}
+
+// extract tar, tar.gz, tar.zst or tar.xz read from r in order
+func (e *extractor) extractTar(format archiveFormat, r io.Reader) error {
+	r, close, err := decompressTar(format, r)
+	if err != nil {
+		return err
+	}
+	defer close()
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return e.restoreDirs()
+		}
+		if err != nil {
+			return fmt.Errorf("read %s failed: %w", format, err)
+		}
+		p, err := e.selected(header.Name)
+		if err != nil {
+			return err
+		}
+		if p == "" {
+			continue
+		}
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeDir:
+			err = e.extract(p, header.FileInfo().Mode(), header.Size, func() (io.ReadCloser, error) {
+				return io.NopCloser(tr), nil
+			})
+		case tar.TypeSymlink:
+			err = e.symlink(p, header.Linkname)
+		case tar.TypeLink:
+			err = e.link(p, header.Linkname)
+		default:
+			logger.Debugf("skip %s of type %q", p, header.Typeflag)
+			continue
+		}
+		if err == nil {
+			err = e.restore(p, header)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// restore owner, mode and modification time of tar entry extracted to p, setuid and setgid are kept only if
+// owner is restored like tar. Directories are restored by restoreDirs, entries extracted in them change their times
+// and a read-only mode would prevent extracting entries in them
+func (e *extractor) restore(p string, header *tar.Header) error {
+	if e.test {
+		return nil
+	}
+	info, err := os.Lstat(p)
+	if os.IsNotExist(err) || header.Typeflag == tar.TypeLink {
+		// symlink skipped, or link sharing attributes of its target
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if e.sameOwner {
+		if err := os.Lchown(p, header.Uid, header.Gid); err != nil {
+			logger.Warnf("restore owner of %s failed: %s", p, err)
+		}
+	}
+	// mode and times of symlink itself can't be set, they would be applied to its target
+	if info.Mode()&fs.ModeSymlink != 0 {
+		return nil
+	}
+	if header.Typeflag == tar.TypeDir {
+		e.dirs = append(e.dirs, extractedDir{path: p, header: header})
+		return nil
+	}
+	return e.restoreModeAndTime(p, header)
+}
+
+func (e *extractor) restoreModeAndTime(p string, header *tar.Header) error {
+	mode := header.FileInfo().Mode()
+	perm := mode & (fs.ModePerm | fs.ModeSticky)
+	if e.sameOwner {
+		perm |= mode & (fs.ModeSetuid | fs.ModeSetgid)
+	}
+	if err := os.Chmod(p, perm); err != nil {
+		return err
+	}
+	return os.Chtimes(p, header.ModTime, header.ModTime)
+}
+
+// restore modification time of zip entry extracted to p, times of directories are restored by restoreDirs
+func (e *extractor) restoreZipTime(p string, f *zip.File) error {
+	if f.Modified.IsZero() {
+		return nil
+	}
+	if f.Mode().IsDir() {
+		e.dirs = append(e.dirs, extractedDir{path: p, modTime: f.Modified})
+		return nil
+	}
+	return os.Chtimes(p, f.Modified, f.Modified)
+}
+
+// restore directories, the deepest first, so restoring a directory doesn't change time of its parent
+func (e *extractor) restoreDirs() error {
+	for i := len(e.dirs) - 1; i >= 0; i-- {
+		dir := e.dirs[i]
+		var err error
+		if dir.header != nil {
+			err = e.restoreModeAndTime(dir.path, dir.header)
+		} else {
+			err = os.Chtimes(dir.path, dir.modTime, dir.modTime)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	e.dirs = nil
+	return nil
+}
+
+// extractWriter extracts archive written to it in order, its format is detected by the first bytes.
+// tar formats are extracted as they are written, zip is kept in a temporary file under root and extracted by Close
+type extractWriter struct {
+	e      *extractor
+	head   []byte
+	format archiveFormat
+	// write side of tar being extracted, done receives result of extraction
+	pw   *io.PipeWriter
+	done chan error
+	// zip and its size
+	temp *os.File
+	size int64
+}
+
+func newExtractWriter(e *extractor) *extractWriter {
+	return &extractWriter{e: e}
+}
+
+func (w *extractWriter) Write(p []byte) (int, error) {
+	if w.format != formatUnknown {
+		return w.write(p)
+	}
+	w.head = append(w.head, p...)
+	if len(w.head) < archiveHeadSize {
+		return len(p), nil
+	}
+	if err := w.start(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *extractWriter) write(p []byte) (int, error) {
+	if w.temp != nil {
+		n, err := w.temp.Write(p)
+		w.size += int64(n)
+		return n, err
+	}
+	return w.pw.Write(p)
+}
+
+// detect format by head and start extraction
+func (w *extractWriter) start() error {
+	format := detectArchive(w.head)
+	switch format {
+	case formatUnknown:
+		return errors.New("unknown archive format, tar, tar.gz, tar.zst, tar.xz and zip are supported")
+	case formatZip:
+		f, err := os.CreateTemp(w.e.root, ".extract-*.zip")
+		if err != nil {
+			return err
+		}
+		w.temp = f
+	default:
+		pr, pw := io.Pipe()
+		w.pw, w.done = pw, make(chan error, 1)
+		go func() {
+			err := w.e.extractTar(format, pr)
+			if err == nil {
+				// padding after the end of tar
+				_, err = io.Copy(io.Discard, pr)
+			}
+			pr.CloseWithError(err)
+			w.done <- err
+		}()
+	}
+	logger.Debugln("archive format:", format)
+	w.format = format
+	head := w.head
+	w.head = nil
+	_, err := w.write(head)
+	return err
+}
+
+// Close waits for extraction of tar, or extracts zip, after the whole archive is written
+func (w *extractWriter) Close() error {
+	if w.format == formatUnknown {
+		if err := w.start(); err != nil {
+			return err
+		}
+	}
+	if w.pw != nil {
+		w.pw.Close()
+		return <-w.done
+	}
+	defer os.Remove(w.temp.Name())
+	defer w.temp.Close()
+	r, err := zip.NewReader(w.temp, w.size)
+	if err != nil {
+		return err
+	}
+	return w.e.extractZip(r)
+}
+
+// abort stops extraction if the archive can't be written completely, entries extracted are kept
+func (w *extractWriter) abort(err error) {
+	if w.pw != nil {
+		w.pw.CloseWithError(err)
+		<-w.done
+	}
+	if w.temp != nil {
+		w.temp.Close()
+		os.Remove(w.temp.Name())
+	}
+}
@@ -1,131 +1,1121 @@
 package cmd
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/x509"
+	"errors"
 	"spaceship/fetch"
 	"spaceship/pkg"
+	"spaceship/pkg/network"
 
 	"fmt"
+	"hash"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/schollz/progressbar/v3"
 	"github.com/spf13/cobra"
 )
 
+// output name of stdout
+const stdoutName = "-"
+
 var fetchCmd = &cobra.Command{
 	Use:     "fetch",
 	Short:   "Concurrent download of web content to local",
-	Example: "fetch <url> <output file?>",
-	Args:    cobra.RangeArgs(1, 2),
+	Example: "fetch <url> <output file?>\nfetch <url> <mirror url>... -o <output file>\nfetch <url> -o - | tar x\nfetch <url of .tar.gz> --extract <dir>\nfetch <file or url of .meta4>\nfetch --hls <playlist url> -o <output.ts>\nfetch -r <url> -d <dir>\nfetch -i urls.txt -d outdir/",
+	Args:    cobra.ArbitraryArgs,
 	Run: func(cmd *cobra.Command, args []string) {
-		u, err := pkg.ParseURL(args[0])
+		inputFile, _ := cmd.Flags().GetString("input-file")
+		dir, _ := cmd.Flags().GetString("dir")
+		output, _ := cmd.Flags().GetString("output")
+		if inputFile != "" {
+			if len(args) > 0 {
+				logger.Fatalln("<url> can't be used with --input-file")
+			}
+			runFetchBatch(cmd, inputFile, dir)
+			return
+		}
+		if len(args) == 0 {
+			logger.Fatalln("require <url> or --input-file")
+		}
+		if recursive, _ := cmd.Flags().GetBool("recursive"); recursive {
+			if len(args) != 1 {
+				logger.Fatalln("--recursive requires one URL")
+			}
+			runFetchRecursive(cmd, args[0], dir)
+			return
+		}
+		if hls, _ := cmd.Flags().GetBool("hls"); hls {
+			if len(args) != 1 {
+				logger.Fatalln("--hls requires one playlist URL")
+			}
+			runFetchHLS(cmd, args[0], output, dir)
+			return
+		}
+		if metalink, _ := cmd.Flags().GetBool("metalink"); metalink && len(args) == 1 && isMetalinkName(args[0]) {
+			if output == stdoutName {
+				logger.Fatalln("files of metalink can't be written to stdout")
+			}
+			runFetchMetalink(cmd, args[0], output, dir)
+			return
+		}
+		// the last argument is output file if it is not a URL with scheme
+		if output == "" && len(args) >= 2 && !network.IsURL(args[len(args)-1]) {
+			output = args[len(args)-1]
+			args = args[:len(args)-1]
+		}
+		urls := make([]string, len(args))
+		for i, arg := range args {
+			u, err := pkg.ParseURL(arg)
+			if err != nil {
+				logger.Fatalln(err)
+			}
+			urls[i] = u.String()
+		}
+		hosts := make([]string, len(urls))
+		for i, rawURL := range urls {
+			u, _ := url.Parse(rawURL)
+			hosts[i] = u.Hostname()
+		}
+		logger.Debugf("url: %s", strings.Join(urls, "  "))
+		fetcher := newFetcherByFlags(cmd, hosts[0], urls...)
+		// content verified by hash doesn't rely on ETag
+		value, _ := cmd.Flags().GetString("checksum")
+		checksumFile, _ := cmd.Flags().GetString("checksum-file")
+		urls, info, err := inspectFile(fetcher, urls, value == "" && checksumFile == "")
 		if err != nil {
 			logger.Fatalln(err)
 		}
-		args[0] = u.String()
-		if len(args) == 1 {
-			if name, err := pkg.ParseFileNameByURLPath(u.Path); err != nil {
-				logger.Fatalf("unable to parse file name by %s, please specify <output file>", args[0])
-			} else {
-				logger.Debugf("parse file name %s by URL path", name)
-				args = append(args, name)
+		if extract, _ := cmd.Flags().GetString("extract"); extract != "" {
+			if output != "" {
+				logger.Fatalln("<output file> can't be used with --extract")
+			}
+			runFetchExtract(cmd, fetcher, urls, info, extract)
+			return
+		}
+		if output == "" {
+			if output, err = fileNameOf(info, urls[0]); err != nil {
+				logger.Fatalf("%s, please specify <output file>", err)
 			}
 		}
+		toStdout := output == stdoutName
+		if dir != "" && !filepath.IsAbs(output) && !toStdout {
+			output = filepath.Join(dir, output)
+		}
 
 		overwrite, _ := cmd.Flags().GetBool("overwrite")
-		if info, err := os.Stat(args[1]); err == nil {
+		newer, _ := cmd.Flags().GetBool("newer")
+		if toStdout && newer {
+			logger.Fatalln("--newer can't be used with output to stdout")
+		}
+		// progress is shown on stderr if the content is written to stdout
+		var barOutput io.Writer = os.Stdout
+		if toStdout {
+			barOutput = os.Stderr
+		} else if info, err := os.Stat(output); err == nil {
 			if info.IsDir() {
-				logger.Fatalf("%s is a directory", args[1])
+				logger.Fatalf("%s is a directory", output)
 			}
-			if !overwrite {
-				logger.Fatalf("%s already exists, you should use --overwrite", args[1])
+			if !overwrite && !newer {
+				logger.Fatalf("%s already exists, you should use --overwrite or --newer", output)
 			}
 		}
-		resolveArr, _ := cmd.Flags().GetStringArray("resolve")
-		resolveHostMap, err := parseResolveFlag(u.Hostname(), resolveArr...)
-		if err != nil {
-			logger.Fatalln(err)
+		if newer {
+			notModified, err := notModifiedSince(fetcher, urls[0], output)
+			if err != nil {
+				logger.Fatalln(err)
+			}
+			if notModified {
+				logger.Infof("%s is not modified, skip", output)
+				return
+			}
 		}
-		concurrency, _ := cmd.Flags().GetInt("concurrency")
-		cookie, _ := cmd.Flags().GetString("cookie")
-		insecure, _ := cmd.Flags().GetBool("insecure")
-		noRedirect, _ := cmd.Flags().GetBool("no-redirect")
-		proxyURL, _ := cmd.Flags().GetString("proxy")
-		enableHTTP2, _ := cmd.Flags().GetBool("http2")
-		headerArr, _ := cmd.Flags().GetStringArray("header")
-		caPath, _ := cmd.Flags().GetString("cacert")
-		var certPool *x509.CertPool
-		if caPath != "" {
-			certPool = handleCACertificate(caPath)
-		}
-		header := parseHeader(headerArr...)
-		if header.Get("Cookie") == "" {
-			header.Set("Cookie", cookie)
-		}
-		logger.Debugf("url: %s  insecure: %v  enable HTTP2: %v  disallow redirects: %v proxy: %s", args[0], insecure, enableHTTP2, noRedirect, proxyURL)
-		logger.Debugf("header: %+v", header)
-		logger.Debugf("resolve host map: %v", resolveHostMap)
-		logger.Debugf("specify CA certificate: %v", certPool != nil)
-		fetcher, err := fetch.NewFetcher(fetch.FetcherOption{
-			InsecureSkipVerify: insecure,
-			DisallowRedirects:  noRedirect,
-			ProxyURL:           proxyURL,
-			DisableHTTP2:       !enableHTTP2,
-			ResolveHostMap:     resolveHostMap,
-			RootCAs:            certPool,
-			ResponsePreInspector: func(when int, resp *http.Response) error {
-				if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
-					bs := make([]byte, 256)
-					n, _ := io.ReadAtLeast(resp.Body, bs, len(bs))
-					lessBody := strings.Trim(string(bs[:n]), "\n\r\t ")
-					return fmt.Errorf("unexpected status \"%s\" and front part of body is \"%s\"", resp.Status, lessBody)
-				}
-				return nil
-			},
+		finalURL, _ := url.Parse(info.URL)
+		checksum := handleChecksum(cmd, fetcher, output, finalURL.Path)
+		if !info.Supported {
+			logger.Warnln("not support ranges")
+		}
+		var bar *progressbar.ProgressBar
+		option := downloadOptionByFlags(cmd)
+		option.OnMirrorFail = func(url string, err error) {
+			bar.Clear()
+			logger.Warnf("mirror %s is given up, its ranges are resumed from other mirrors: %s", url, err)
+		}
+		bar = newBar(info.Length,
+			progressbar.OptionSetDescription("Downloading [cyan]"+output+"[reset]..."),
+			progressbar.OptionSetWriter(barOutput),
+		)
+		// the old file is kept until the new one is downloaded
+		target := output
+		if newer {
+			target = output + ".temp"
+		}
+		err = fetchFile(fetcher, urls, info, target, option, checksum, func(n int) {
+			bar.Add(n)
 		})
+		if err == nil && newer {
+			err = os.Rename(target, output)
+		}
+		if err != nil {
+			bar.Exit()
+			fmt.Fprintln(barOutput)
+			logger.Fatalln("download failed:", err.Error())
+		}
+		bar.Finish()
+		fmt.Fprintln(barOutput)
+		if newer {
+			saveValidators(output, info)
+		}
+		if checksum != nil {
+			logger.Infof("%s checksum verified", checksum.Algorithm)
+		}
+		logger.Infoln("download success")
+	},
+}
+
+// create fetcher by flags, hostname is used when resolve flag has no host,
+// credentials of --user, --bearer or .netrc are only sent to origins of authURLs
+func newFetcherByFlags(cmd *cobra.Command, hostname string, authURLs ...string) *fetch.Fetcher {
+	resolveArr, _ := cmd.Flags().GetStringArray("resolve")
+	resolveHostMap, err := parseResolveFlag(hostname, resolveArr...)
+	if err != nil {
+		logger.Fatalln(err)
+	}
+	limitRate := getRateFlag(cmd, "limit-rate")
+	maxPerHost, _ := cmd.Flags().GetInt("max-per-host")
+	cookie, _ := cmd.Flags().GetString("cookie")
+	insecure, _ := cmd.Flags().GetBool("insecure")
+	noRedirect, _ := cmd.Flags().GetBool("no-redirect")
+	proxyURL, _ := cmd.Flags().GetString("proxy")
+	enableHTTP2, _ := cmd.Flags().GetBool("http2")
+	headerArr, _ := cmd.Flags().GetStringArray("header")
+	caPath, _ := cmd.Flags().GetString("cacert")
+	var certPool *x509.CertPool
+	if caPath != "" {
+		certPool = handleCACertificate(caPath)
+	}
+	header := parseHeader(headerArr...)
+	if header.Get("Cookie") == "" {
+		header.Set("Cookie", cookie)
+	}
+	logger.Debugf("insecure: %v  enable HTTP2: %v  disallow redirects: %v proxy: %s", insecure, enableHTTP2, noRedirect, proxyURL)
+	logger.Debugf("header: %+v", header)
+	logger.Debugf("resolve host map: %v  limit rate: %d/s  max connections per host: %d", resolveHostMap, limitRate, maxPerHost)
+	logger.Debugf("specify CA certificate: %v", certPool != nil)
+	var jar http.CookieJar
+	if cookieJar, _ := cmd.Flags().GetString("cookie-jar"); cookieJar != "" {
+		jar = newSavedCookieJar(cookieJar)
+	}
+	credentials := credentialsByFlags(cmd, authURLs)
+	fetcher, err := fetch.NewFetcher(fetch.FetcherOption{
+		InsecureSkipVerify: insecure,
+		DisallowRedirects:  noRedirect,
+		ProxyURL:           proxyURL,
+		DisableHTTP2:       !enableHTTP2,
+		ResolveHostMap:     resolveHostMap,
+		RootCAs:            certPool,
+		LimitRate:          limitRate,
+		MaxConnsPerHost:    maxPerHost,
+		Jar:                jar,
+		Credentials:        credentials,
+		ResponsePreInspector: func(when int, resp *http.Response) error {
+			if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+				bs := make([]byte, 256)
+				n, _ := io.ReadAtLeast(resp.Body, bs, len(bs))
+				lessBody := strings.Trim(string(bs[:n]), "\n\r\t ")
+				return fmt.Errorf("unexpected status \"%s\" and front part of body is \"%s\"", resp.Status, lessBody)
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		logger.Fatalln(err)
+	}
+	mergeHeader(fetcher.Header, header)
+	return fetcher
+}
+
+// cookie jar which is saved back to its Netscape cookie file whenever cookies are set,
+// so cookies are kept even if the command exits on failure
+type savedCookieJar struct {
+	*fetch.CookieJar
+	name string
+	l    sync.Mutex
+}
+
+func newSavedCookieJar(name string) *savedCookieJar {
+	jar := &savedCookieJar{CookieJar: fetch.NewCookieJar(), name: name}
+	if err := jar.LoadFile(name); err != nil {
+		logger.Fatalf("load cookie jar %s failed: %s", name, err)
+	}
+	// create the file even if no cookie is set
+	jar.save()
+	return jar
+}
+
+func (jar *savedCookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	jar.CookieJar.SetCookies(u, cookies)
+	jar.save()
+}
+
+func (jar *savedCookieJar) save() {
+	jar.l.Lock()
+	defer jar.l.Unlock()
+	if err := jar.SaveFile(jar.name); err != nil {
+		logger.Warnf("save cookie jar %s failed: %s", jar.name, err)
+	}
+}
+
+// credentials of --user or --bearer by origins of urls, or of .netrc if both are absent,
+// origins without credentials are omitted
+func credentialsByFlags(cmd *cobra.Command, urls []string) map[string]*fetch.Credentials {
+	user, _ := cmd.Flags().GetString("user")
+	bearer, _ := cmd.Flags().GetString("bearer")
+	netrc, _ := cmd.Flags().GetBool("netrc")
+	netrcFile, _ := cmd.Flags().GetString("netrc-file")
+	if user != "" && bearer != "" {
+		logger.Fatalln("specify either --user or --bearer")
+	}
+	var c *fetch.Credentials
+	if bearer != "" {
+		c = &fetch.Credentials{Bearer: bearer}
+	} else if user != "" {
+		name, password, ok := strings.Cut(user, ":")
+		if !ok {
+			var err error
+			if password, err = readPassword(fmt.Sprintf("Please input password of %s: ", name), false); err != nil {
+				logger.Fatalln(err)
+			}
+		}
+		c = &fetch.Credentials{User: name, Password: password}
+	}
+	credentials := make(map[string]*fetch.Credentials)
+	for _, rawURL := range urls {
+		u, err := url.Parse(rawURL)
+		if err != nil || u.Host == "" {
+			continue
+		}
+		origin, host := fetch.Origin(u), u.Hostname()
+		if c != nil {
+			credentials[origin] = c
+			continue
+		}
+		if !netrc && netrcFile == "" {
+			continue
+		}
+		machine, err := fetch.LookupNetrc(netrcFile, host)
+		if err != nil {
+			logger.Fatalln("read netrc failed:", err)
+		}
+		if machine != nil && machine.Login != "" {
+			logger.Debugf("credentials of %s are found in netrc", host)
+			credentials[origin] = &fetch.Credentials{User: machine.Login, Password: machine.Password}
+		}
+	}
+	return credentials
+}
+
+// replace values of dst by values of src
+func mergeHeader(dst http.Header, src http.Header) {
+	for key, value := range src {
+		dst.Del(key)
+		for _, v := range value {
+			dst.Add(key, v)
+		}
+	}
+}
+
+func downloadOptionByFlags(cmd *cobra.Command) fetch.DownloadOption {
+	concurrency, _ := cmd.Flags().GetInt("concurrency")
+	adaptive, _ := cmd.Flags().GetBool("adaptive")
+	chunkMinStr, _ := cmd.Flags().GetString("chunk-min")
+	chunkMaxStr, _ := cmd.Flags().GetString("chunk-max")
+	chunkMin, err := pkg.ParseSize(chunkMinStr)
+	if err != nil {
+		logger.Fatalln("invalid --chunk-min:", err)
+	}
+	chunkMax, err := pkg.ParseSize(chunkMaxStr)
+	if err != nil {
+		logger.Fatalln("invalid --chunk-max:", err)
+	}
+	return fetch.DownloadOption{
+		Concurrency:         concurrency,
+		ChunkSizeMin:        chunkMin,
+		ChunkSizeMax:        chunkMax,
+		AdaptiveConcurrency: adaptive,
+	}
+}
+
+// inspect urls which are mirrors of the same content, mirrors failed to inspect are dropped with warnings,
+// info is of the first usable URL
+func inspectFile(fetcher *fetch.Fetcher, urls []string, checkETag bool) ([]string, *fetch.Inspection, error) {
+	if len(urls) == 1 {
+		info, err := fetcher.Inspect(urls[0])
+		return urls, info, err
+	}
+	urls, info, failures, err := fetcher.InspectMirrors(urls, checkETag)
+	if err != nil {
+		return nil, nil, err
+	}
+	for mirror, err := range failures {
+		logger.Warnf("mirror %s is skipped: %s", mirror, err)
+	}
+	logger.Debugf("download from %d mirrors", len(urls))
+	return urls, info, nil
+}
+
+// name of the file to save, by Content-Disposition first, then path of the final URL after redirects,
+// then path of rawURL, it is sanitized since it is given by remote
+func fileNameOf(info *fetch.Inspection, rawURL string) (string, error) {
+	var names []string
+	if info.FileName != "" {
+		names = append(names, info.FileName)
+	}
+	for _, s := range []string{info.URL, rawURL} {
+		if u, err := url.Parse(s); err == nil {
+			if name, err := pkg.ParseFileNameByURLPath(u.Path); err == nil {
+				names = append(names, name)
+			}
+		}
+	}
+	for _, name := range names {
+		safe, err := pkg.SanitizeFileName(name)
+		if err != nil {
+			logger.Debugf("file name %q is ignored: %s", name, err)
+			continue
+		}
+		if safe != name {
+			logger.Debugf("file name %q is sanitized to %s", name, safe)
+		}
+		return safe, nil
+	}
+	return "", fmt.Errorf("unable to parse file name by %s", rawURL)
+}
+
+// whether content of url is not modified since output was downloaded, validators are read from the sidecar
+// file of output, or modification time of output is used if it is absent, false if output doesn't exist
+func notModifiedSince(fetcher *fetch.Fetcher, url string, output string) (bool, error) {
+	info, err := os.Stat(output)
+	if err != nil {
+		return false, nil
+	}
+	v, err := fetch.LoadValidators(output)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Warnf("validators of %s are ignored: %s", output, err)
+		}
+		v = &fetch.Validators{LastModified: info.ModTime()}
+	}
+	logger.Debugf("validators of %s: %+v", output, *v)
+	inspection, err := fetcher.InspectIfChanged(url, v)
+	if err != nil {
+		return false, err
+	}
+	return inspection.NotModified, nil
+}
+
+// keep validators of info for --newer of next fetch, modification time of output is set by Last-Modified
+func saveValidators(output string, info *fetch.Inspection) {
+	if !info.LastModified.IsZero() {
+		os.Chtimes(output, time.Now(), info.LastModified)
+	}
+	if err := fetch.SaveValidators(output, fetch.ValidatorsOf(info)); err != nil {
+		logger.Warnf("save validators of %s failed: %s", output, err)
+	}
+}
+
+// download urls inspected by inspectFile to output and verify checksum if not nil, the output is removed
+// if checksum mismatches, urls are mirrors of the same content, onWrite is called after every write.
+// If-Range is sent unless there are mirrors, so a change during download fails instead of mixing contents
+func fetchFile(fetcher *fetch.Fetcher, urls []string, info *fetch.Inspection, output string, option fetch.DownloadOption, checksum *fetch.Checksum, onWrite func(n int)) error {
+	url := urls[0]
+	option.Mirrors = urls[1:]
+	if len(urls) == 1 {
+		option.IfRange = fetch.ValidatorsOf(info).IfRange()
+	}
+	if output == stdoutName {
+		return fetchToStream(fetcher, url, info, option, checksum, os.Stdout, "stdout", onWrite)
+	}
+	if dir := filepath.Dir(output); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	fw, err := fetch.NewFileWriter(output)
+	if err != nil {
+		return err
+	}
+	defer fw.Close()
+	fw.OnWrite(func(n int, index int, start, end, length int64) {
+		onWrite(n)
+	})
+	var hasher *fetch.PrefixHasher
+	if checksum != nil {
+		hasher = fetch.NewPrefixHasher(output, checksum.NewHash(), fw.Prefix)
+		hasher.Start()
+	}
+	option.HookContext = fw.HookContext
+	if err := fetcher.DownloadWithManual(url, info.Supported, info.Length, &option); err != nil {
+		return err
+	}
+	if err := fw.Truncate(fw.WrittenN()); err != nil {
+		return err
+	}
+	if hasher != nil {
+		sum, err := hasher.Sum(fw.WrittenN())
+		if err == nil {
+			logger.Debugf("%s of %s hashed during download", pkg.FormatSize(hasher.Hashed()), pkg.FormatSize(fw.WrittenN()))
+			err = checksum.Verify(sum)
+		}
+		if err != nil {
+			fw.Close()
+			os.Remove(output)
+			return fmt.Errorf("%s, %s removed", err, output)
+		}
+	}
+	return nil
+}
+
+// download to stream w named name in order, ranges downloaded ahead are buffered in memory,
+// the content is hashed while it is written since it can't be read back
+func fetchToStream(fetcher *fetch.Fetcher, url string, info *fetch.Inspection, option fetch.DownloadOption, checksum *fetch.Checksum, w io.Writer, name string, onWrite func(n int)) error {
+	var h hash.Hash
+	if checksum != nil {
+		h = checksum.NewHash()
+		w = io.MultiWriter(w, h)
+	}
+	sink := fetch.NewStreamSink(w, 0)
+	fw := fetch.NewWriter(sink)
+	defer fw.Close()
+	fw.OnWrite(func(n int, index int, start, end, length int64) {
+		onWrite(n)
+	})
+	option.HookContext = fw.HookContext
+	if err := fetcher.DownloadWithManual(url, info.Supported, info.Length, &option); err != nil {
+		return err
+	}
+	if err := fw.Truncate(fw.WrittenN()); err != nil {
+		return err
+	}
+	if h != nil {
+		if err := checksum.Verify(h.Sum(nil)); err != nil {
+			return fmt.Errorf("%s, content written to %s is corrupt", err, name)
+		}
+	}
+	return nil
+}
+
+// download archive and extract it to root instead of saving it
+func runFetchExtract(cmd *cobra.Command, fetcher *fetch.Fetcher, urls []string, info *fetch.Inspection, root string) {
+	if newer, _ := cmd.Flags().GetBool("newer"); newer {
+		logger.Fatalln("--newer can't be used with --extract")
+	}
+	// name of archive is only used to look up checksum and show progress
+	name, err := fileNameOf(info, urls[0])
+	if err != nil {
+		name = urls[0]
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		logger.Fatalln(err)
+	}
+	w := newExtractWriter(newExtractorByFlags(cmd, root))
+	finalURL, _ := url.Parse(info.URL)
+	checksum := handleChecksum(cmd, fetcher, name, finalURL.Path)
+	if !info.Supported {
+		logger.Warnln("not support ranges")
+	}
+	var bar *progressbar.ProgressBar
+	option := downloadOptionByFlags(cmd)
+	option.OnMirrorFail = func(url string, err error) {
+		bar.Clear()
+		logger.Warnf("mirror %s is given up, its ranges are resumed from other mirrors: %s", url, err)
+	}
+	option.Mirrors = urls[1:]
+	if len(urls) == 1 {
+		option.IfRange = fetch.ValidatorsOf(info).IfRange()
+	}
+	bar = newBar(info.Length, progressbar.OptionSetDescription("Extracting [cyan]"+name+"[reset] to [green]"+root+"[reset]..."))
+	err = fetchToStream(fetcher, urls[0], info, option, checksum, w, root, func(n int) {
+		bar.Add(n)
+	})
+	if err != nil {
+		w.abort(err)
+	} else {
+		// zip is extracted after download
+		err = w.Close()
+	}
+	if err != nil {
+		bar.Exit()
+		fmt.Println()
+		logger.Fatalln("extract failed:", err.Error())
+	}
+	bar.Finish()
+	fmt.Println()
+	if checksum != nil {
+		logger.Infof("%s checksum verified", checksum.Algorithm)
+	}
+	logger.Infoln("extract success")
+}
+
+// download URLs listed in input file to dir, one file failed does not abort others
+func runFetchBatch(cmd *cobra.Command, inputFile string, dir string) {
+	jobs, _ := cmd.Flags().GetInt("jobs")
+	retry, _ := cmd.Flags().GetInt("retry")
+	report, _ := cmd.Flags().GetString("report")
+	overwrite, _ := cmd.Flags().GetBool("overwrite")
+	newer, _ := cmd.Flags().GetBool("newer")
+	if value, _ := cmd.Flags().GetString("checksum"); value != "" {
+		logger.Fatalln("--checksum can't be used with --input-file, use --checksum-file instead")
+	}
+	entries, err := loadManifest(inputFile)
+	if err != nil {
+		logger.Fatalln(err)
+	}
+	// dst is kept relative to dir, so that the report can be used with the same flags
+	outputOf := func(dst string) string {
+		if dir != "" && !filepath.IsAbs(dst) {
+			return filepath.Join(dir, dst)
+		}
+		return filepath.Clean(dst)
+	}
+	// entries without dst are named by response when they are downloaded
+	var outputsLock sync.Mutex
+	outputs := make(map[string]*batchEntry)
+	for _, entry := range entries {
+		u, err := pkg.ParseURL(entry.Src)
 		if err != nil {
 			logger.Fatalln(err)
 		}
-		for key, value := range header {
-			fetcher.Header.Del(key)
-			for _, v := range value {
-				fetcher.Header.Add(key, v)
+		entry.Src = u.String()
+		if entry.Dst == "" {
+			continue
+		}
+		if other, ok := outputs[outputOf(entry.Dst)]; ok {
+			logger.Fatalf("%s and %s are both downloaded to %s", other.Src, entry.Src, outputOf(entry.Dst))
+		}
+		outputs[outputOf(entry.Dst)] = entry
+	}
+	var urls []string
+	for _, entry := range entries {
+		urls = append(urls, entry.Src)
+	}
+	// resolve flag without host applies to all URLs
+	fetcher := newFetcherByFlags(cmd, "*", urls...)
+	checksumFile, _ := cmd.Flags().GetString("checksum-file")
+	var checksumContent []byte
+	if checksumFile != "" {
+		checksumContent = readChecksumFile(fetcher, checksumFile)
+	}
+	option := downloadOptionByFlags(cmd)
+	logger.Debugf("input file: %s  dir: %s  jobs: %d  retry: %d  report: %s", inputFile, dir, jobs, retry, report)
+
+	bar := newBar(-1)
+	// progress of downloading files, shown in description of bar
+	type progress struct {
+		written int64
+		length  int64
+	}
+	var l sync.Mutex
+	active := make(map[*batchEntry]*progress)
+	var done int64
+	describe := func() {
+		l.Lock()
+		defer l.Unlock()
+		desc := fmt.Sprintf("Downloading [%d/%d]", atomic.LoadInt64(&done), len(entries))
+		for _, entry := range entries {
+			p, ok := active[entry]
+			if !ok {
+				continue
+			}
+			written, length := atomic.LoadInt64(&p.written), atomic.LoadInt64(&p.length)
+			if length > 0 {
+				desc += fmt.Sprintf(" [cyan]%s[reset] %d%%", filepath.Base(entry.Dst), written*100/length)
+			} else {
+				desc += fmt.Sprintf(" [cyan]%s[reset] %s", filepath.Base(entry.Dst), pkg.FormatSize(written))
 			}
 		}
-		supported, length, err := fetcher.Inspect(args[0])
+		bar.Describe(desc + "...")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		ticker := time.NewTicker(time.Millisecond * 500)
+		defer ticker.Stop()
+		for {
+			describe()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	for _, entry := range entries {
+		if entry.Status == batchStatusSuccess {
+			atomic.AddInt64(&done, 1)
+		}
+	}
+	failures := runBatch(entries, batchOption{
+		Jobs:  jobs,
+		Retry: retry,
+		Bar:   bar,
+		Do: func(entry *batchEntry) error {
+			f := fetcher
+			if len(entry.Header) > 0 {
+				f = fetcher.Clone()
+				mergeHeader(f.Header, parseHeader(entry.Header...))
+			}
+			urls, info, err := inspectFile(f, []string{entry.Src}, checksumContent == nil)
+			if err != nil {
+				return err
+			}
+			if entry.Dst == "" {
+				name, err := fileNameOf(info, entry.Src)
+				if err != nil {
+					return fmt.Errorf("%s, please specify output name in %s", err, inputFile)
+				}
+				output := outputOf(name)
+				outputsLock.Lock()
+				other, ok := outputs[output]
+				if !ok {
+					outputs[output] = entry
+				}
+				outputsLock.Unlock()
+				if ok {
+					return fmt.Errorf("%s is also downloaded to %s, please specify output name in %s", other.Src, output, inputFile)
+				}
+				entry.Dst = name
+			}
+			output := outputOf(entry.Dst)
+			if info, err := os.Stat(output); err == nil {
+				if info.IsDir() {
+					return fmt.Errorf("%s is a directory", output)
+				}
+				if !overwrite && !newer {
+					return fmt.Errorf("%s already exists, you should use --overwrite or --newer", output)
+				}
+			}
+			if newer {
+				notModified, err := notModifiedSince(f, entry.Src, output)
+				if err != nil {
+					return err
+				}
+				if notModified {
+					logger.Debugf("%s is not modified, skip", output)
+					if stat, err := os.Stat(output); err == nil {
+						entry.Size = stat.Size()
+					}
+					atomic.AddInt64(&done, 1)
+					return nil
+				}
+			}
+			var checksum *fetch.Checksum
+			if checksumContent != nil {
+				u, _ := url.Parse(info.URL)
+				if checksum, err = lookupChecksum(checksumContent, entry.Dst, u.Path); err != nil {
+					return err
+				}
+			}
+			p := &progress{length: info.Length}
+			entry.Size = info.Length
+			l.Lock()
+			active[entry] = p
+			l.Unlock()
+			defer func() {
+				l.Lock()
+				delete(active, entry)
+				l.Unlock()
+			}()
+			tempFile := output + ".temp"
+			err = fetchFile(f, urls, info, tempFile, option, checksum, func(n int) {
+				atomic.AddInt64(&p.written, int64(n))
+				bar.Add(n)
+			})
+			if err == nil {
+				err = os.Rename(tempFile, output)
+			}
+			if err != nil {
+				bar.Add64(-atomic.LoadInt64(&p.written))
+				return err
+			}
+			if newer {
+				saveValidators(output, info)
+			}
+			atomic.AddInt64(&done, 1)
+			return nil
+		},
+	})
+	cancel()
+	bar.Clear()
+	bar.Close()
+	fmt.Println()
+	finishBatch(entries, failures, report, "input-file")
+}
+
+// get expected checksum by flag "checksum" or "checksum-file", nil if not specified
+func handleChecksum(cmd *cobra.Command, fetcher *fetch.Fetcher, output string, urlPath string) *fetch.Checksum {
+	value, _ := cmd.Flags().GetString("checksum")
+	checksumFile, _ := cmd.Flags().GetString("checksum-file")
+	if value != "" && checksumFile != "" {
+		logger.Fatalln("specify either --checksum or --checksum-file")
+	}
+	if value != "" {
+		checksum, err := fetch.ParseChecksum(value)
 		if err != nil {
 			logger.Fatalln(err)
 		}
-		if !supported {
-			logger.Warnln("not support ranges")
+		return checksum
+	}
+	if checksumFile == "" {
+		return nil
+	}
+	checksum, err := lookupChecksum(readChecksumFile(fetcher, checksumFile), output, urlPath)
+	if err != nil {
+		logger.Fatalln(err)
+	}
+	return checksum
+}
+
+// read checksum file from local or URL
+func readChecksumFile(fetcher *fetch.Fetcher, checksumFile string) []byte {
+	content, err := readFileOrURL(fetcher, checksumFile)
+	if err != nil {
+		logger.Fatalln("read checksum file failed:", err)
+	}
+	return content
+}
+
+// read content of local file, or URL if name is a URL
+func readFileOrURL(fetcher *fetch.Fetcher, name string) ([]byte, error) {
+	if !network.IsURL(name) {
+		return os.ReadFile(name)
+	}
+	resp, err := fetcher.DoWithRetry(func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, name, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status \"%s\" of %s", resp.Status, name)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// mirror pages and their links under the directory of rawURL into dir
+func runFetchRecursive(cmd *cobra.Command, rawURL string, dir string) {
+	u, err := pkg.ParseURL(rawURL)
+	if err != nil {
+		logger.Fatalln(err)
+	}
+	if dir == "" {
+		dir = "."
+	}
+	jobs, _ := cmd.Flags().GetInt("jobs")
+	depth, _ := cmd.Flags().GetInt("depth")
+	allowParent, _ := cmd.Flags().GetBool("allow-parent")
+	ignoreRobots, _ := cmd.Flags().GetBool("ignore-robots")
+	convertLinks, _ := cmd.Flags().GetBool("convert-links")
+	option := &fetch.CrawlOption{
+		Dir:          dir,
+		Depth:        depth,
+		AllowParent:  allowParent,
+		IgnoreRobots: ignoreRobots,
+		ConvertLinks: convertLinks,
+		Jobs:         jobs,
+		Download:     downloadOptionByFlags(cmd),
+	}
+	for _, name := range []string{"accept", "reject"} {
+		expr, _ := cmd.Flags().GetString(name)
+		if expr == "" {
+			continue
 		}
-		fw, err := fetch.NewFileWriter(args[1])
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			logger.Fatalf("invalid --%s: %s", name, err)
+		}
+		if name == "accept" {
+			option.Accept = re
+		} else {
+			option.Reject = re
+		}
+	}
+	fetcher := newFetcherByFlags(cmd, u.Hostname(), u.String())
+	logger.Debugf("url: %s  dir: %s  depth: %d  jobs: %d", u, dir, depth, jobs)
+	bar := newBar(-1, progressbar.OptionSetDescription("Mirroring [cyan]"+u.String()+"[reset]..."))
+	// Clear of bar is not guarded by lock of bar
+	var l sync.Mutex
+	option.OnWrite = func(n int) {
+		l.Lock()
+		defer l.Unlock()
+		bar.Add(n)
+	}
+	option.OnFile = func(u string, output string, status string, size int64, err error) {
+		l.Lock()
+		defer l.Unlock()
+		bar.Clear()
+		switch status {
+		case fetch.CrawlFailed:
+			logger.Errorf("%s %s: %s", logger.Red("[failure]"), u, err)
+		case fetch.CrawlUnchanged:
+			logger.Infof("[unchanged] %s => %s", u, output)
+		default:
+			logger.Infof("%s %s => %s  %s", logger.Green("[success]"), u, output, pkg.FormatSize(size))
+		}
+	}
+	stats, err := fetcher.Crawl(u.String(), option)
+	bar.Clear()
+	bar.Close()
+	fmt.Println()
+	if err != nil {
+		logger.Fatalln(err)
+	}
+	if stats.Failed > 0 {
+		logger.Fatalf("%d downloaded, %d unchanged, %d failed", stats.Downloaded, stats.Unchanged, stats.Failed)
+	}
+	logger.Infof("%d downloaded, %d unchanged", stats.Downloaded, stats.Unchanged)
+}
+
+// download HLS stream and concatenate segments into a .ts file
+func runFetchHLS(cmd *cobra.Command, rawURL string, output string, dir string) {
+	u, err := pkg.ParseURL(rawURL)
+	if err != nil {
+		logger.Fatalln(err)
+	}
+	if output == "" {
+		name, err := pkg.ParseFileNameByURLPath(u.Path)
+		if err != nil {
+			logger.Fatalf("unable to parse file name by %s, please specify --output", u)
+		}
+		output = strings.TrimSuffix(name, path.Ext(name)) + ".ts"
+	}
+	toStdout := output == stdoutName
+	if dir != "" && !filepath.IsAbs(output) && !toStdout {
+		output = filepath.Join(dir, output)
+	}
+	overwrite, _ := cmd.Flags().GetBool("overwrite")
+	var barOutput io.Writer = os.Stdout
+	if toStdout {
+		barOutput = os.Stderr
+	} else if info, err := os.Stat(output); err == nil {
+		if info.IsDir() {
+			logger.Fatalf("%s is a directory", output)
+		}
+		if !overwrite {
+			logger.Fatalf("%s already exists, you should use --overwrite", output)
+		}
+	}
+	concurrency, _ := cmd.Flags().GetInt("concurrency")
+	variantSpec, _ := cmd.Flags().GetString("variant")
+	fetcher := newFetcherByFlags(cmd, u.Hostname(), u.String())
+	playlist, err := fetcher.FetchHLSPlaylist(u.String())
+	if err != nil {
+		logger.Fatalln("fetch playlist failed:", err)
+	}
+	if playlist.IsMaster() {
+		variant, err := fetch.SelectHLSVariant(playlist.Variants, variantSpec)
 		if err != nil {
 			logger.Fatalln(err)
 		}
-		defer fw.Close()
-		bar := newBar(length,
-			progressbar.OptionSetDescription("Downloading [cyan]"+args[1]+"[reset]..."),
-		)
-		fw.OnWrite(func(n int, index int, start, end, length int64) {
+		logger.Infof("select variant of bandwidth %d resolution %dx%d from %d variants", variant.Bandwidth, variant.Width, variant.Height, len(playlist.Variants))
+		logger.Debugln("variant playlist:", variant.URL)
+		if playlist, err = fetcher.FetchHLSPlaylist(variant.URL); err != nil {
+			logger.Fatalln("fetch variant playlist failed:", err)
+		}
+		if playlist.IsMaster() {
+			logger.Fatalln("variant playlist is also a master playlist")
+		}
+	}
+	if len(playlist.Segments) == 0 {
+		logger.Fatalln("no segment in playlist")
+	}
+	if !playlist.Ended {
+		logger.Warnln("playlist has no #EXT-X-ENDLIST, it may be live, only current segments are downloaded")
+	}
+	f := os.Stdout
+	if !toStdout {
+		if dir := filepath.Dir(output); dir != "." {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				logger.Fatalln(err)
+			}
+		}
+		if f, err = os.Create(output); err != nil {
+			logger.Fatalln(err)
+		}
+	}
+	total := len(playlist.Segments)
+	if playlist.Map != nil {
+		total++
+	}
+	bar := newBar(-1,
+		progressbar.OptionSetDescription(fmt.Sprintf("Downloading [cyan]%s[reset] [0/%d]...", output, total)),
+		progressbar.OptionSetWriter(barOutput),
+	)
+	w := bufio.NewWriterSize(f, 1024*1024)
+	err = fetcher.DownloadHLS(playlist, w, &fetch.HLSOption{
+		Concurrency: concurrency,
+		OnSegment: func(index int, n int) {
+			bar.Describe(fmt.Sprintf("Downloading [cyan]%s[reset] [%d/%d]...", output, index+1, total))
 			bar.Add(n)
-		})
-		if err := fetcher.DownloadWithManual(args[0], supported, length, &fetch.DownloadOption{
-			Concurrency: concurrency,
-			HookContext: fw.HookContext,
-		}); err != nil {
+		},
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if toStdout {
+		if err != nil {
+			bar.Exit()
+			fmt.Fprintln(barOutput)
+			logger.Fatalln("download failed:", err)
+		}
+	} else {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
 			bar.Exit()
 			fmt.Println()
-			logger.Fatalln("download failed:", err.Error())
+			os.Remove(output)
+			logger.Fatalf("download failed: %s, %s removed", err, output)
 		}
-		bar.Finish()
+	}
+	bar.Finish()
+	fmt.Fprintln(barOutput)
+	logger.Infof("%d segments written to %s", total, output)
+}
+
+// whether name is a Metalink file or URL by extension
+func isMetalinkName(name string) bool {
+	if network.IsURL(name) {
+		if u, err := url.Parse(name); err == nil {
+			name = u.Path
+		}
+	}
+	ext := strings.ToLower(path.Ext(name))
+	return ext == ".meta4" || ext == ".metalink"
+}
+
+// download files described by Metalink, mirrors are used by priority, whole file hash and piece hashes are verified
+func runFetchMetalink(cmd *cobra.Command, source string, output string, dir string) {
+	overwrite, _ := cmd.Flags().GetBool("overwrite")
+	var urls []string
+	if network.IsURL(source) {
+		urls = append(urls, source)
+	}
+	// mirrors are on different hosts
+	fetcher := newFetcherByFlags(cmd, "*", urls...)
+	content, err := readFileOrURL(fetcher, source)
+	if err != nil {
+		logger.Fatalln("read metalink failed:", err)
+	}
+	files, err := fetch.ParseMetalink(bytes.NewReader(content))
+	if err != nil {
+		logger.Fatalln(err)
+	}
+	if output != "" && len(files) > 1 {
+		logger.Fatalf("%s describes %d files, --output can't be used", source, len(files))
+	}
+	var failures int
+	for _, file := range files {
+		if err := fetchMetalinkFile(cmd, fetcher, file, output, dir, overwrite); err != nil {
+			failures++
+			logger.Errorf("%s %s: %s", logger.Red("[failure]"), file.Name, err)
+		}
+	}
+	if failures > 0 {
+		logger.Fatalf("%d of %d files failed", failures, len(files))
+	}
+	logger.Infoln("download success")
+}
+
+func fetchMetalinkFile(cmd *cobra.Command, fetcher *fetch.Fetcher, file *fetch.MetalinkFile, output string, dir string, overwrite bool) error {
+	if output == "" {
+		name, err := file.SafeName()
+		if err != nil {
+			return err
+		}
+		output = filepath.FromSlash(name)
+	}
+	if dir != "" && !filepath.IsAbs(output) {
+		output = filepath.Join(dir, output)
+	}
+	if info, err := os.Stat(output); err == nil {
+		if info.IsDir() {
+			return fmt.Errorf("%s is a directory", output)
+		}
+		if !overwrite {
+			return fmt.Errorf("%s already exists, you should use --overwrite", output)
+		}
+	}
+	if len(file.URLs) == 0 {
+		return errors.New("no HTTP or HTTPS URL")
+	}
+	logger.Debugf("metalink file: %s  size: %d  urls: %s", file.Name, file.Size, strings.Join(file.URLs, "  "))
+	if file.Checksum == nil {
+		logger.Warnf("no hash of %s in metalink", file.Name)
+	}
+	option := downloadOptionByFlags(cmd)
+	option.Pieces = file.Pieces
+	// content verified by hash doesn't rely on ETag
+	urls, info, err := inspectFile(fetcher, file.URLs, file.Checksum == nil && file.Pieces == nil)
+	if err != nil {
+		return err
+	}
+	if file.Size >= 0 && info.Length >= 0 && info.Length != file.Size {
+		return fmt.Errorf("length %d differs from size %d in metalink", info.Length, file.Size)
+	}
+	if !info.Supported {
+		logger.Warnln("not support ranges")
+	}
+	bar := newBar(info.Length,
+		progressbar.OptionSetDescription("Downloading [cyan]"+output+"[reset]..."),
+	)
+	option.OnMirrorFail = func(url string, err error) {
+		bar.Clear()
+		logger.Warnf("mirror %s is given up, its ranges are resumed from other mirrors: %s", url, err)
+	}
+	if err := fetchFile(fetcher, urls, info, output, option, file.Checksum, func(n int) {
+		bar.Add(n)
+	}); err != nil {
+		bar.Exit()
 		fmt.Println()
-		fw.Truncate(fw.WrittenN())
-		logger.Infoln("download success")
-	},
+		return err
+	}
+	bar.Finish()
+	fmt.Println()
+	if file.Checksum != nil {
+		logger.Infof("%s of %s verified", file.Checksum.Algorithm, output)
+	}
+	return nil
+}
+
+// look up checksum in content of checksum file by output name first, then name in URL
+func lookupChecksum(content []byte, output string, urlPath string) (*fetch.Checksum, error) {
+	names := []string{filepath.Base(output)}
+	if name, err := pkg.ParseFileNameByURLPath(urlPath); err == nil && name != names[0] {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		if checksum, err := fetch.LookupChecksum(bytes.NewReader(content), name); err == nil {
+			logger.Debugf("checksum of %s: %s", name, checksum)
+			return checksum, nil
+		} else {
+			logger.Debugln(err)
+		}
+	}
+	return nil, fmt.Errorf("checksum of %s not found in checksum file", strings.Join(names, " or "))
 }
 
 func init() {
@@ -137,9 +1127,37 @@ func init() {
 	fetchCmd.Flags().StringArray("resolve", []string{}, "resolve host, * for all, eg. example.com:127.0.0.1  *:127.0.0.1")
 	fetchCmd.Flags().BoolP("insecure", "k", false, "insecure skip verify")
 	fetchCmd.Flags().String("cacert", "", "CA certificate path")
-	fetchCmd.Flags().IntP("concurrency", "c", 12, "number of concurrent goroutines")
+	fetchCmd.Flags().IntP("concurrency", "c", 12, "number of concurrent goroutines of each file")
+	fetchCmd.Flags().Int("max-per-host", 0, "maximum connections per host of all files, 0 means unlimited")
+	fetchCmd.Flags().String("chunk-min", "256K", "minimum size of a range request, the rest of a slow range is split only if it is at least twice of it")
+	fetchCmd.Flags().String("chunk-max", "16M", "maximum size of a range request")
+	fetchCmd.Flags().String("limit-rate", "0", "limit download rate per second of all goroutines, eg. 500K 5M, 0 means unlimited")
+	fetchCmd.Flags().Bool("adaptive", false, "adjust number of connections between 1 and concurrency by measured throughput")
 	fetchCmd.Flags().StringArrayP("header", "H", []string{}, "header, example: -H \"Cookie:a=1\"")
 	fetchCmd.Flags().StringP("cookie", "C", "", "cookie, example: -C \"a=1\"")
+	fetchCmd.Flags().String("cookie-jar", "", "load cookies from Netscape cookie file and save cookies back to it")
+	fetchCmd.Flags().StringP("user", "u", "", "user and password of Basic or Digest authentication, example: -u user:pass, password is asked if omitted")
+	fetchCmd.Flags().String("bearer", "", "bearer token of authentication")
+	fetchCmd.Flags().Bool("netrc", true, "look up credentials of host in ~/.netrc if --user and --bearer are absent")
+	fetchCmd.Flags().String("netrc-file", "", "look up credentials in this file instead of ~/.netrc")
 	fetchCmd.Flags().Bool("overwrite", false, "overwrite")
+	fetchCmd.Flags().Bool("newer", false, "download only if remote file changed since last fetch, its ETag and Last-Modified are kept in <output>.validators")
+	fetchCmd.Flags().String("checksum", "", "verify checksum after download, md5 sha1 sha256 sha512 are supported, eg. sha256:<hex>")
+	fetchCmd.Flags().StringP("input-file", "i", "", "download URLs listed in file, lines of \"<url> <output?>\" with options like out=<output> header=<header>, indented lines add options to the previous URL, or JSON/YAML list of {src, dst, header}")
+	fetchCmd.Flags().StringP("output", "o", "", "output file, - for stdout, all arguments are regarded as mirror URLs of the same file if specified")
+	fetchCmd.Flags().Bool("metalink", true, "download files described by a .meta4 or .metalink file or URL, use --metalink=false to download the Metalink itself")
+	fetchCmd.Flags().Bool("hls", false, "download HLS stream of m3u8 playlist, segments are decrypted and concatenated into a .ts file")
+	fetchCmd.Flags().String("variant", "best", "variant of HLS master playlist, best worst <height>p <width>x<height> or max bandwidth like 3000000")
+	fetchCmd.Flags().BoolP("recursive", "r", false, "mirror pages and files linked from URL like wget -r, files are saved as <dir>/<host>/<path>, --jobs files at the same time")
+	fetchCmd.Flags().Int("depth", 5, "maximum depth of links to follow when using --recursive, 0 means unlimited")
+	fetchCmd.Flags().Bool("allow-parent", false, "follow links out of the directory of URL when using --recursive")
+	fetchCmd.Flags().String("accept", "", "regexp of URLs to save when using --recursive, pages are still parsed for links")
+	fetchCmd.Flags().String("reject", "", "regexp of URLs never requested when using --recursive")
+	fetchCmd.Flags().Bool("ignore-robots", false, "ignore robots.txt when using --recursive")
+	fetchCmd.Flags().Bool("convert-links", false, "rewrite links of saved pages for offline browsing when using --recursive, originals are kept as .orig for next run")
+	addExtractFlags(fetchCmd)
+	fetchCmd.Flags().StringP("dir", "d", "", "directory to save files, relative output is joined with it")
+	addBatchRunFlags(fetchCmd, "input-file")
+	fetchCmd.Flags().String("checksum-file", "", "file or URL of checksums like SHA256SUMS, the expected checksum is looked up by file name")
 	rootCmd.AddCommand(fetchCmd)
 }
@@ -4,6 +4,10 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
 
 	"spaceship/fetch"
 	"spaceship/ship"
@@ -16,23 +20,25 @@ import (
 var getCmd = &cobra.Command{
 	Use:     "get",
 	Short:   "Concurrent download remote file to local",
-	Example: "get <remote path> <local path?>",
+	Example: "  get <remote path> <local path?>\n  get <remote path of .tar.gz> --extract <dir>\n  get --from-file manifest.txt -j 4 --report result.json",
 
 	Run: func(cmd *cobra.Command, args []string) {
-		if len(args) < 1 || len(args) > 2 {
+		fromFile, _ := cmd.Flags().GetString("from-file")
+		if fromFile == "" && (len(args) < 1 || len(args) > 2) {
 			logger.Fatalln("args length error, require <path> <output file?>")
+		} else if fromFile != "" && len(args) > 0 {
+			logger.Fatalln("args are not allowed when --from-file is specified")
 		}
 		var (
 			serverURL  = viper.GetString(NameServerURL)
 			proxyURL   = viper.GetString(NameProxyURL)
 			insecure   = viper.GetBool(NameInsecureSkipVerify)
 			noRedirect = viper.GetBool(NameDisallowRedirects)
-			remoteFile = args[0]
-			localFile  = remoteFile
 		)
 		resolveArr, _ := cmd.Flags().GetStringArray("resolve")
 		concurrency, _ := cmd.Flags().GetInt("concurrency")
 		enableHTTP2, _ := cmd.Flags().GetBool("http2")
+		limitRate := getRateFlag(cmd, "limit-rate")
 		overwrite, _ := cmd.Flags().GetBool("overwrite")
 		auth, _ := cmd.Flags().GetString("auth")
 		caPath, _ := cmd.Flags().GetString("cacert")
@@ -47,12 +53,29 @@ var getCmd = &cobra.Command{
 				DisableHTTP2:       !enableHTTP2,
 				ResolveHostMap:     resolveHostMap,
 				RootCAs:            certPool,
+				LimitRate:          limitRate,
 			},
 		})
 		if err != nil {
 			logger.Fatalln(err)
 		}
 		client.SetAuth(handleAuth(auth), true)
+		if fromFile != "" {
+			if extract, _ := cmd.Flags().GetString("extract"); extract != "" {
+				logger.Fatalln("--extract can't be used with --from-file")
+			}
+			runGetBatch(cmd, client, fromFile, concurrency, overwrite)
+			return
+		}
+		remoteFile := args[0]
+		if extract, _ := cmd.Flags().GetString("extract"); extract != "" {
+			if len(args) == 2 {
+				logger.Fatalln("<local path> can't be used with --extract")
+			}
+			runGetExtract(cmd, client, concurrency, remoteFile, extract)
+			return
+		}
+		localFile := remoteFile
 		if len(args) == 2 {
 			localFile = args[1]
 		}
@@ -72,7 +95,7 @@ var getCmd = &cobra.Command{
 		var bar *progressbar.ProgressBar
 		logger.Debugln("target url:", client.GetDownloadFileURL(remoteFile))
 		logger.Debugf("councurrency: %d  overwrite: %v  insecure: %v  enable HTTP2: %v  disallow redirects: %v  proxy: %s", concurrency, overwrite, insecure, enableHTTP2, noRedirect, proxyURL)
-		logger.Debugf("resolve host map: %v", resolveHostMap)
+		logger.Debugf("resolve host map: %v  limit rate: %d/s", resolveHostMap, limitRate)
 		logger.Debugf("specify CA certificate: %v", certPool != nil)
 		if err := client.Get(concurrency, remoteFile, tempFile, func(beforeDownload bool, supported bool, length int64, n int) {
 			if beforeDownload {
@@ -105,9 +128,131 @@ var getCmd = &cobra.Command{
 	},
 }
 
+// download remote archive and extract it to root during download, zip is extracted after download
+func runGetExtract(cmd *cobra.Command, client *ship.Client, concurrency int, remoteFile string, root string) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		logger.Fatalln(err)
+	}
+	w := newExtractWriter(newExtractorByFlags(cmd, root))
+	var bar *progressbar.ProgressBar
+	err := client.GetTo(concurrency, remoteFile, fetch.NewStreamSink(w, 0), func(beforeDownload bool, supported bool, length int64, n int) {
+		if beforeDownload {
+			if !supported {
+				logger.Warnln("not support ranges")
+			}
+			bar = newBar(length, progressbar.OptionSetDescription("Extracting [cyan]"+remoteFile+"[reset] to [green]"+root+"[reset]..."))
+		} else {
+			bar.Add(n)
+		}
+	})
+	if err != nil {
+		w.abort(err)
+	} else {
+		err = w.Close()
+	}
+	if err != nil {
+		if bar != nil {
+			bar.Exit()
+			fmt.Println()
+		}
+		logger.Fatalln("extract failed:", err.Error())
+	}
+	bar.Finish()
+	fmt.Println()
+	logger.Infoln("extract success")
+}
+
+// download files listed in manifest, existing local files are replaced only after download finished
+func runGetBatch(cmd *cobra.Command, client *ship.Client, manifest string, concurrency int, overwrite bool) {
+	jobs, _ := cmd.Flags().GetInt("jobs")
+	retry, _ := cmd.Flags().GetInt("retry")
+	report, _ := cmd.Flags().GetString("report")
+	entries, err := loadManifest(manifest)
+	if err != nil {
+		logger.Fatalln(err)
+	}
+	sizes := make(map[string]int64)
+	if err := client.List(func(info *ship.FileInfo) {
+		sizes[info.Name] = info.Size
+	}); err != nil {
+		logger.Warnln("list remote files failed, total size is unknown:", err)
+	}
+	var total int64
+	for _, entry := range entries {
+		entry.Src = ship.CleanPath(entry.Src)
+		if entry.Dst == "" {
+			entry.Dst = entry.Src
+		} else if strings.HasSuffix(entry.Dst, "/") || strings.HasSuffix(entry.Dst, `\`) {
+			entry.Dst = filepath.Join(entry.Dst, path.Base(entry.Src))
+		} else if info, err := os.Stat(entry.Dst); err == nil && info.IsDir() {
+			entry.Dst = filepath.Join(entry.Dst, path.Base(entry.Src))
+		}
+		if size, ok := sizes[entry.Src]; ok && entry.Status != batchStatusSuccess {
+			total += size
+		}
+	}
+	logger.Debugf("manifest: %s  jobs: %d  retry: %d  report: %s", manifest, jobs, retry, report)
+	max := total
+	if max <= 0 {
+		max = -1
+	}
+	bar := newBar(max, progressbar.OptionSetDescription("Downloading [cyan]"+strconv.Itoa(len(entries))+"[reset] files..."))
+	failures := runBatch(entries, batchOption{
+		Jobs:  jobs,
+		Retry: retry,
+		Bar:   bar,
+		Do: func(entry *batchEntry) error {
+			var written int64
+			err := getFile(client, concurrency, entry.Src, entry.Dst, overwrite, func(beforeDownload bool, supported bool, length int64, n int) {
+				if beforeDownload {
+					entry.Size = length
+				} else {
+					atomic.AddInt64(&written, int64(n))
+					bar.Add(n)
+				}
+			})
+			if err != nil {
+				bar.Add64(-atomic.LoadInt64(&written))
+			}
+			return err
+		},
+	})
+	bar.Clear()
+	bar.Close()
+	fmt.Println()
+	finishBatch(entries, failures, report, "from-file")
+}
+
+// download remote file to a temp file next to local file, then rename it to local file
+func getFile(client *ship.Client, concurrency int, remoteFile string, localFile string, overwrite bool, hook func(beforeDownload bool, supported bool, length int64, n int)) error {
+	if info, err := os.Stat(localFile); err == nil {
+		if info.IsDir() {
+			return fmt.Errorf("%s is a directory", localFile)
+		}
+		if !overwrite {
+			return fmt.Errorf("%s already exists, you should use --overwrite", localFile)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if dir := filepath.Dir(localFile); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	tempFile := localFile + ".temp"
+	if err := client.Get(concurrency, remoteFile, tempFile, hook); err != nil {
+		os.Remove(tempFile)
+		return err
+	}
+	return os.Rename(tempFile, localFile)
+}
+
 func init() {
 	addSpacestationFlags(getCmd)
 	addTransportFlags(getCmd)
+	addBatchFlags(getCmd)
 	getCmd.Flags().Bool("overwrite", false, "if local file exists, overwrite")
+	addExtractFlags(getCmd)
 	rootCmd.AddCommand(getCmd)
 }
@@ -88,6 +88,58 @@ func handleAuth(auth string) (authHash string) {
 	return
 }
 
+// add flag "password" "password-file", usage tells what the password is for
+func addPasswordFlags(cmd *cobra.Command, usage string) {
+	cmd.Flags().String("password", "", usage)
+	cmd.Flags().String("password-file", "", usage+", it is read from the first line of file")
+}
+
+// password of flag "password" or "password-file", empty if both are absent
+func passwordOfFlags(cmd *cobra.Command) string {
+	password, _ := cmd.Flags().GetString("password")
+	passwordFile, _ := cmd.Flags().GetString("password-file")
+	if password != "" && passwordFile != "" {
+		logger.Fatalln("specify either --password or --password-file")
+	}
+	if passwordFile != "" {
+		bs, err := os.ReadFile(passwordFile)
+		if err != nil {
+			logger.Fatalln(err)
+		}
+		password, _, _ = strings.Cut(string(bs), "\n")
+		password = strings.TrimSuffix(password, "\r")
+	}
+	return password
+}
+
+// read password from terminal, it is asked again to confirm if confirm is true
+func readPassword(prompt string, confirm bool) (string, error) {
+	read := func(prompt string) (string, error) {
+		// stdout may be the output of a download or an archive
+		fmt.Fprint(os.Stderr, prompt)
+		password, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		return string(password), err
+	}
+	password, err := read(prompt)
+	if err != nil {
+		return "", err
+	}
+	if password == "" {
+		return "", errors.New("empty password")
+	}
+	if confirm {
+		again, err := read("Please input password again: ")
+		if err != nil {
+			return "", err
+		}
+		if again != password {
+			return "", errors.New("passwords don't match")
+		}
+	}
+	return password, nil
+}
+
 func handleResolveHostMap(serverURL string, resolveArr ...string) map[string]string {
 	u, err := pkg.ParseURL(serverURL)
 	if err != nil {
@@ -107,12 +159,23 @@ func handleResolveHostMap(serverURL string, resolveArr ...string) map[string]str
 	return resolveHostMap
 }
 
-// add flag "http2"
+// add flag "http2" "concurrency" "limit-rate"
 func addTransportFlags(cmd *cobra.Command) {
 	// 默认禁用http2是因为http2共用TCP连接，多路复用，对于并发下载大文件效率并没有HTTP/1.1高，
 	// 此外可能出现"stream error: stream ID 5; INTERNAL_ERROR; received from peer" 的错误
 	cmd.Flags().Bool("http2", false, "enable HTTP2 when uploading or downloading")
 	cmd.Flags().IntP("concurrency", "c", 12, "number of concurrent goroutines")
+	cmd.Flags().String("limit-rate", "0", "limit transfer rate per second of all goroutines, eg. 500K 5M, 0 means unlimited")
+}
+
+// get rate of flag like "limit-rate", fatal if invalid
+func getRateFlag(cmd *cobra.Command, name string) int64 {
+	v, _ := cmd.Flags().GetString(name)
+	rate, err := pkg.ParseSize(v)
+	if err != nil {
+		logger.Fatalf("invalid --%s: %s", name, err)
+	}
+	return rate
 }
 
 // add flag "url" "auth" "no-redirect" "insecure" "proxy" "resolve" "cacert"
@@ -0,0 +1,235 @@
+package cmd
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// default name of ignore files of spaceship, it has the same syntax as .gitignore
+const defaultIgnoreFile = ".spaceshipignore"
+
+// a line of ignore file
+type ignoreRule struct {
+	// slash-separated segments, "**" matches zero or more directories
+	pattern []string
+	negate  bool
+	dirOnly bool
+}
+
+// rules of ignore files in a directory, patterns are relative to dir
+type ignoreRules struct {
+	dir   string
+	rules []ignoreRule
+}
+
+// ignoreMatcher decides whether paths met during walk are ignored by .gitignore and ignore files in the same syntax.
+// Ignore files are read when their directories are met, a rule of a deeper file or a later line takes precedence,
+// and .git/info/exclude and ignore files of parent directories up to the root of git repository are also read.
+type ignoreMatcher struct {
+	// names of ignore files looked up in every directory, in order of precedence from low to high
+	names []string
+	// .git is always ignored if gitignore is used
+	git bool
+	// absolute directory where rules are looked up until, the walk root or root of git repository
+	top string
+	// rules of directories read, nil if there is no ignore file
+	dirs map[string]*ignoreRules
+	// rules of .git/info/exclude, they have the lowest precedence
+	exclude *ignoreRules
+}
+
+// create matcher of walk from root, nil if neither gitignore nor ignoreFile is used
+func newIgnoreMatcher(root string, gitignore bool, ignoreFile string) (*ignoreMatcher, error) {
+	if !gitignore && ignoreFile == "" {
+		return nil, nil
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(root); err == nil && !info.IsDir() {
+		root = filepath.Dir(root)
+	}
+	m := &ignoreMatcher{git: gitignore, top: root, dirs: make(map[string]*ignoreRules)}
+	if gitignore {
+		m.names = append(m.names, ".gitignore")
+		if gitRoot := findGitRoot(root); gitRoot != "" {
+			m.top = gitRoot
+			if m.exclude, err = readIgnoreFile(gitRoot, filepath.Join(gitRoot, ".git", "info", "exclude")); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if ignoreFile != "" {
+		m.names = append(m.names, ignoreFile)
+	}
+	return m, nil
+}
+
+// nearest directory containing .git from dir upwards, empty if dir isn't in a git repository
+func findGitRoot(dir string) string {
+	for {
+		if _, err := os.Lstat(filepath.Join(dir, ".git")); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// read rules of ignore file, no rule if it doesn't exist
+func readIgnoreFile(dir string, name string) (*ignoreRules, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rules := &ignoreRules{dir: dir}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if rule, ok := parseIgnoreLine(scanner.Text()); ok {
+			rules.rules = append(rules.rules, rule)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	logger.Debugf("%d rules are read from %s", len(rules.rules), name)
+	return rules, nil
+}
+
+// parse a line of gitignore syntax, false if it is blank or a comment
+func parseIgnoreLine(line string) (ignoreRule, bool) {
+	line = strings.TrimSuffix(line, "\r")
+	// trailing spaces are ignored unless they are escaped
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+	var rule ignoreRule
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return ignoreRule{}, false
+	}
+	// a pattern without separator except the trailing one matches at any level
+	if !strings.Contains(line, "/") {
+		line = "**/" + line
+	}
+	// path.Match negates character class by "^" instead of "!"
+	line = strings.ReplaceAll(line, "[!", "[^")
+	rule.pattern = strings.Split(strings.TrimPrefix(line, "/"), "/")
+	return rule, true
+}
+
+// whether name relative to dir of the rule matches it, "a/**" matches everything in a but not a itself
+func (rule *ignoreRule) match(name []string, isDir bool) bool {
+	if rule.dirOnly && !isDir {
+		return false
+	}
+	if n := len(rule.pattern); n > 1 && rule.pattern[n-1] == "**" && len(name) < n {
+		return false
+	}
+	return matchGlobParts(rule.pattern, name)
+}
+
+// rules of ignore files in dir, they are read once
+func (m *ignoreMatcher) rulesOf(dir string) ([]*ignoreRules, error) {
+	var all []*ignoreRules
+	for _, name := range m.names {
+		key := filepath.Join(dir, name)
+		rules, ok := m.dirs[key]
+		if !ok {
+			var err error
+			if rules, err = readIgnoreFile(dir, key); err != nil {
+				return nil, err
+			}
+			m.dirs[key] = rules
+		}
+		if rules != nil {
+			all = append(all, rules)
+		}
+	}
+	return all, nil
+}
+
+// whether p is ignored, p is a path met during walk
+func (m *ignoreMatcher) ignored(p string, isDir bool) (bool, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return false, err
+	}
+	if m.git && isDir && filepath.Base(abs) == ".git" {
+		return true, nil
+	}
+	// directories from top down to parent of p
+	var dirs []string
+	for dir := filepath.Dir(abs); ; dir = filepath.Dir(dir) {
+		dirs = append(dirs, dir)
+		if dir == m.top || filepath.Dir(dir) == dir {
+			break
+		}
+	}
+	chain := []*ignoreRules{}
+	if m.exclude != nil {
+		chain = append(chain, m.exclude)
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		rules, err := m.rulesOf(dirs[i])
+		if err != nil {
+			return false, err
+		}
+		chain = append(chain, rules...)
+	}
+	ignored := false
+	for _, rules := range chain {
+		rel, err := filepath.Rel(rules.dir, abs)
+		if err != nil {
+			return false, err
+		}
+		name := strings.Split(filepath.ToSlash(rel), "/")
+		for i := range rules.rules {
+			if rules.rules[i].match(name, isDir) {
+				ignored = !rules.rules[i].negate
+			}
+		}
+	}
+	return ignored, nil
+}
+
+// add flag "gitignore" "ignore-file" to skip files when walking directories
+func addIgnoreFlags(cmd *cobra.Command) {
+	cmd.Flags().Bool("gitignore", false, "skip files ignored by .gitignore, .git/info/exclude and .gitignore of subdirectories and parent directories in the repository, .git is skipped too")
+	cmd.Flags().String("ignore-file", defaultIgnoreFile, "name of ignore files in .gitignore syntax looked up in every directory, empty to disable")
+}
+
+// create ignoreMatcher of walk from root by flags of addIgnoreFlags
+func newIgnoreMatcherByFlags(cmd *cobra.Command, root string) *ignoreMatcher {
+	gitignore, _ := cmd.Flags().GetBool("gitignore")
+	ignoreFile, _ := cmd.Flags().GetString("ignore-file")
+	m, err := newIgnoreMatcher(root, gitignore, ignoreFile)
+	if err != nil {
+		logger.Fatalln(err)
+	}
+	return m
+}
@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
 
 	"spaceship/fetch"
 	"spaceship/ship"
@@ -16,25 +19,27 @@ import (
 var putCmd = &cobra.Command{
 	Use:     "put",
 	Short:   "Concurrent upload local file to remote",
-	Example: "put <local path> <remote path?> ",
+	Example: "  put <local path> <remote path?>\n  put --from-file manifest.txt -j 4 --report result.json",
 
 	Run: func(cmd *cobra.Command, args []string) {
-		if len(args) < 1 || len(args) > 2 {
+		fromFile, _ := cmd.Flags().GetString("from-file")
+		if fromFile == "" && (len(args) < 1 || len(args) > 2) {
 			logger.Fatalln("args length error, require <local path> <remote path?>")
+		} else if fromFile != "" && len(args) > 0 {
+			logger.Fatalln("args are not allowed when --from-file is specified")
 		}
 		var (
 			serverURL  = viper.GetString(NameServerURL)
 			proxyURL   = viper.GetString(NameProxyURL)
 			insecure   = viper.GetBool(NameInsecureSkipVerify)
 			noRedirect = viper.GetBool(NameDisallowRedirects)
-			localFile  = args[0]
-			remoteFile = path.Base(localFile)
 		)
 		auth, _ := cmd.Flags().GetString("auth")
 		resolveArr, _ := cmd.Flags().GetStringArray("resolve")
 		overwrite, _ := cmd.Flags().GetBool("overwrite")
 		concurrency, _ := cmd.Flags().GetInt("concurrency")
 		enableHTTP2, _ := cmd.Flags().GetBool("http2")
+		limitRate := getRateFlag(cmd, "limit-rate")
 		caPath, _ := cmd.Flags().GetString("cacert")
 		certPool := handleCACertificate(caPath)
 		resolveHostMap := handleResolveHostMap(serverURL, resolveArr...)
@@ -47,13 +52,19 @@ var putCmd = &cobra.Command{
 				DisableHTTP2:       !enableHTTP2,
 				ResolveHostMap:     resolveHostMap,
 				RootCAs:            certPool,
+				LimitRate:          limitRate,
 			},
 		})
 		if err != nil {
 			logger.Fatalln(err)
 		}
 		client.SetAuth(handleAuth(auth), true)
-
+		if fromFile != "" {
+			runPutBatch(cmd, client, fromFile, concurrency, overwrite)
+			return
+		}
+		localFile := args[0]
+		remoteFile := path.Base(localFile)
 		if len(args) == 2 {
 			remoteFile = args[1]
 		}
@@ -68,7 +79,7 @@ var putCmd = &cobra.Command{
 		var bar *progressbar.ProgressBar
 		logger.Debugln("target url:", client.GetUploadFileURL(remoteFile))
 		logger.Debugf("councurrency: %d  overwrite: %v  insecure: %v  enable HTTP2: %v  disallow redirects: %v  proxy: %s", concurrency, overwrite, insecure, enableHTTP2, noRedirect, proxyURL)
-		logger.Debugf("resolve host map: %v", resolveHostMap)
+		logger.Debugf("resolve host map: %v  limit rate: %d/s", resolveHostMap, limitRate)
 		logger.Debugf("specify CA certificate: %v", certPool != nil)
 		if err := client.Put(concurrency, overwrite, localFile, remoteFile, func(beforeUpload bool, info ship.UploadInfo, n int) {
 			if beforeUpload {
@@ -92,9 +103,69 @@ var putCmd = &cobra.Command{
 	},
 }
 
+// upload files listed in manifest
+func runPutBatch(cmd *cobra.Command, client *ship.Client, manifest string, concurrency int, overwrite bool) {
+	jobs, _ := cmd.Flags().GetInt("jobs")
+	retry, _ := cmd.Flags().GetInt("retry")
+	report, _ := cmd.Flags().GetString("report")
+	entries, err := loadManifest(manifest)
+	if err != nil {
+		logger.Fatalln(err)
+	}
+	var total int64
+	for _, entry := range entries {
+		if entry.Dst == "" {
+			entry.Dst = filepath.Base(entry.Src)
+		}
+		entry.Dst = ship.CleanPath(entry.Dst)
+		if info, err := os.Stat(entry.Src); err == nil && !info.IsDir() && entry.Status != batchStatusSuccess {
+			total += info.Size()
+		}
+	}
+	if overwrite {
+		logger.Warnln("if remote file or upload task exists, overwrite")
+	}
+	logger.Debugf("manifest: %s  jobs: %d  retry: %d  report: %s", manifest, jobs, retry, report)
+	max := total
+	if max <= 0 {
+		max = -1
+	}
+	bar := newBar(max, progressbar.OptionSetDescription("Uploading [cyan]"+strconv.Itoa(len(entries))+"[reset] files..."))
+	failures := runBatch(entries, batchOption{
+		Jobs:  jobs,
+		Retry: retry,
+		Bar:   bar,
+		Do: func(entry *batchEntry) error {
+			if info, err := os.Stat(entry.Src); err != nil {
+				return err
+			} else if info.IsDir() {
+				return fmt.Errorf("%s is a directory", entry.Src)
+			}
+			var written int64
+			err := client.Put(concurrency, overwrite, entry.Src, entry.Dst, func(beforeUpload bool, info ship.UploadInfo, n int) {
+				if beforeUpload {
+					entry.Size = info.TotalSize
+				} else {
+					atomic.AddInt64(&written, int64(n))
+					bar.Add(n)
+				}
+			})
+			if err != nil {
+				bar.Add64(-atomic.LoadInt64(&written))
+			}
+			return err
+		},
+	})
+	bar.Clear()
+	bar.Close()
+	fmt.Println()
+	finishBatch(entries, failures, report, "from-file")
+}
+
 func init() {
 	addSpacestationFlags(putCmd)
 	addTransportFlags(putCmd)
+	addBatchFlags(putCmd)
 	putCmd.Flags().Bool("overwrite", false, "if remote file or upload task exists, overwrite")
 	rootCmd.AddCommand(putCmd)
 }
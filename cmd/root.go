@@ -30,12 +30,13 @@ var rootCmd = &cobra.Command{
 			pkg.SetLogLevel(pkg.LFATAL)
 		}
 		name := cmd.Name()
-		for _, v := range []string{"fetch", "gencert", "install", "serve", "unzip", "version", "zip"} {
+		for _, v := range []string{"fetch", "gencert", "install", "serve", "version", "zip"} {
 			if name == v {
 				return
 			}
 		}
-		if name != "conf" {
+		// local archives of unzip are not remote paths
+		if name != "conf" && name != "unzip" {
 			for i := 0; i < len(args); i++ {
 				args[i] = ship.CleanPath(args[i])
 			}
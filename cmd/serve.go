@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/signal"
 
+	"spaceship/pkg"
 	"spaceship/ship"
 
 	"github.com/spf13/cobra"
@@ -27,13 +28,17 @@ var serveCmd = &cobra.Command{
 		prefix, _ := cmd.Flags().GetString("prefix")
 		keyfile, _ := cmd.Flags().GetString("keyfile")
 		certfile, _ := cmd.Flags().GetString("certfile")
+		limitRate := getRateFlag(cmd, "limit-rate")
+		limitRatePerClient := getRateFlag(cmd, "limit-rate-per-client")
 		if !(certfile == "" && keyfile == "") && !(certfile != "" && keyfile != "") {
 			logger.Fatalln("specify either both certfile and keyfile or none")
 		}
 		svc := ship.NewService(ship.ServiceOption{
-			URLPathPrefix: prefix,
-			Root:          root,
-			Auth:          auth,
+			URLPathPrefix:      prefix,
+			Root:               root,
+			Auth:               auth,
+			LimitRate:          limitRate,
+			LimitRatePerClient: limitRatePerClient,
 		})
 		srv := http.Server{
 			Addr:    addr,
@@ -47,6 +52,9 @@ var serveCmd = &cobra.Command{
 			logger.Infof("Use Auth: %s", logger.Yellow("false"))
 		}
 		logger.Infof("Use TLS certificate: %v", certfile != "")
+		if limitRate > 0 || limitRatePerClient > 0 {
+			logger.Infof("Limit rate: %s/s  per client: %s/s", pkg.FormatSize(limitRate), pkg.FormatSize(limitRatePerClient))
+		}
 		logger.Infof("Listen address: %s", addr)
 		go func() {
 			var err error
@@ -59,7 +67,7 @@ var serveCmd = &cobra.Command{
 				logger.Fatalln(err)
 			}
 		}()
-		ch := make(chan os.Signal)
+		ch := make(chan os.Signal, 1)
 		signal.Notify(ch, os.Interrupt)
 		<-ch
 		logger.Info("Shutting down server...")
@@ -77,5 +85,7 @@ func init() {
 	serveCmd.Flags().String("addr", "127.0.0.1:8080", "listen address")
 	serveCmd.Flags().String("keyfile", "", "specify private key file")
 	serveCmd.Flags().String("certfile", "", "specify certificate file")
+	serveCmd.Flags().String("limit-rate", "0", "limit download and upload rate per second of all clients, eg. 500K 5M, 0 means unlimited")
+	serveCmd.Flags().String("limit-rate-per-client", "0", "limit download and upload rate per second of each client IP, 0 means unlimited")
 	rootCmd.AddCommand(serveCmd)
 }
@@ -1,45 +1,105 @@
 package cmd
 
 import (
+	"archive/tar"
+	"bufio"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
 	"path"
-	"regexp"
-	"spaceship/pkg"
-	"strings"
 	"time"
 
+	"spaceship/fetch"
+	"spaceship/pkg"
+	"spaceship/pkg/network"
+	"spaceship/ship"
+
 	"github.com/klauspost/compress/zip"
+	"github.com/schollz/progressbar/v3"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 var unzipCmd = &cobra.Command{
-	Use:   "unzip",
-	Short: "Unarchive zip",
-	Args:  cobra.ExactArgs(1),
+	Use:     "unzip",
+	Short:   "Unarchive zip, tar, tar.gz, tar.zst or tar.xz",
+	Long:    "Unarchive zip, tar, tar.gz, tar.zst or tar.xz, the format is detected by content.\nA URL or a remote path of --remote is read by range requests, only the central directory and selected entries of zip are downloaded",
+	Example: "  unzip <file>\n  unzip <file> 'src/**/*.go' docs\n  unzip -l https://example.com/a.zip\n  unzip --remote <remote path of zip> --exclude <regexp>",
+	Args:    cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		concat := func(v float64, unit string) string {
-			integer := int64(v)
-			unit = strings.TrimSuffix(unit, "B")
-			if float64(integer) == float64(v) {
-				return fmt.Sprintf("%d%s", integer, unit)
-			} else {
-				return fmt.Sprintf("%.1f%s", v, unit)
+		list, _ := cmd.Flags().GetBool("list")
+		test, _ := cmd.Flags().GetBool("test")
+		if list && test {
+			logger.Fatalln("--list can't be used with --test")
+		}
+		patterns := args[1:]
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				logger.Fatalf("invalid pattern %s: %s", pattern, err)
 			}
 		}
-		list, _ := cmd.Flags().GetBool("list")
-		if list && len(args) > 1 {
-			logger.Fatalln("only one zip can be listed at a time")
+		var (
+			r      io.ReaderAt
+			size   int64
+			remote *fetch.ReaderAt
+		)
+		if isRemote, _ := cmd.Flags().GetBool("remote"); isRemote || network.IsURL(args[0]) {
+			remote = openRemoteArchive(cmd, args[0], isRemote)
+			r, size = remote, remote.Size()
+		} else {
+			f, err := os.Open(args[0])
+			if err != nil {
+				logger.Fatalln(err)
+			}
+			defer f.Close()
+			info, err := f.Stat()
+			if err != nil {
+				logger.Fatalln(err)
+			}
+			r, size = f, info.Size()
 		}
-		zipReader, err := zip.OpenReader(args[0])
-		if err != nil {
+		head := make([]byte, archiveHeadSize)
+		n, err := r.ReadAt(head, 0)
+		if err != nil && err != io.EOF {
 			logger.Fatalln(err)
 		}
-		defer zipReader.Close()
+		format := detectArchive(head[:n])
+		if format == formatUnknown {
+			logger.Fatalln(args[0], "is not a zip, tar, tar.gz, tar.zst or tar.xz archive")
+		}
+		logger.Debugln("archive format:", format)
+		var zipReader *zip.Reader
+		if format == formatZip {
+			if zipReader, err = zip.NewReader(r, size); err != nil {
+				logger.Fatalln(err)
+			}
+			charset, _ := cmd.Flags().GetString("charset")
+			if err := decodeZipNames(zipReader, charset); err != nil {
+				logger.Fatalln(err)
+			}
+		} else if remote != nil {
+			logger.Warnf("%s has no central directory, the whole archive is read", format)
+		}
+		if remote != nil {
+			defer func() {
+				logger.Infof("%s of %s fetched by %d range requests",
+					pkg.FormatSize(remote.Fetched(), concat), pkg.FormatSize(size, concat), remote.Requests())
+			}()
+		}
+		sr := io.NewSectionReader(r, 0, size)
 
 		if list {
+			if zipReader == nil {
+				if err := listTar(format, sr, patterns); err != nil {
+					logger.Fatalln(err)
+				}
+				return
+			}
 			for _, f := range zipReader.File {
+				if !matchInclude(patterns, f.Name) {
+					continue
+				}
 				fmt.Printf("%s\t%s\t%s\t%s\n",
 					f.Mode(),
 					pkg.FormatSize(f.UncompressedSize64, concat),
@@ -50,87 +110,156 @@ var unzipCmd = &cobra.Command{
 			return
 		}
 		root, _ := cmd.Flags().GetString("root")
-		all, _ := cmd.Flags().GetBool("all")
-		overwrite, _ := cmd.Flags().GetBool("overwrite")
-		rule, _ := cmd.Flags().GetString("exclude")
-		excludeRegexp, err := regexp.Compile(rule)
-		if err != nil {
-			logger.Fatalln(err)
-		}
-		root = path.Clean(strings.ReplaceAll(root, `\`, `/`))
-		if info, err := os.Stat(root); err != nil {
-			logger.Fatalln(err)
-		} else if !info.IsDir() {
-			logger.Fatalln(root, " is not a directory")
+		e := newExtractorByFlags(cmd, root)
+		e.verbose, _ = cmd.Flags().GetBool("verbose")
+		e.include = patterns
+		e.test = test
+		var tr io.Reader = sr
+		var bar *progressbar.ProgressBar
+		if !e.verbose {
+			description := "Extracting [cyan]" + args[0] + "[reset] to [green]" + root + "[reset]..."
+			if test {
+				description = "Testing [cyan]" + args[0] + "[reset]..."
+			}
+			// zip by extracted bytes of selected entries, tar by bytes read of archive
+			if zipReader != nil {
+				bar = newBar(selectedSize(e, zipReader), progressbar.OptionSetDescription(description))
+				e.progress = bar
+			} else {
+				bar = newBar(size, progressbar.OptionSetDescription(description))
+				tr = io.TeeReader(sr, bar)
+			}
 		}
-		if all {
-			logger.Debugln("unarchive all files, the regexp to exclude was ignored")
+		start := time.Now()
+		if zipReader != nil {
+			err = e.extractZip(zipReader)
 		} else {
-			logger.Debugln("regexp to exclude:", excludeRegexp.String())
+			err = e.extractTar(format, bufio.NewReaderSize(tr, 1024*1024))
 		}
-		start := time.Now()
-		for _, f := range zipReader.File {
-			p := path.Join(root, path.Clean(strings.TrimLeft(strings.ReplaceAll(f.Name, `\`, `/`), "/")))
-			mode := f.Mode()
-			if !all && (excludeRegexp.MatchString(p) || excludeRegexp.MatchString(path.Base(p))) {
-				logger.Warnln("skip", p, "because it matched regexp to exclude")
-				continue
-			}
-			if pkg.GetLogLevel() <= pkg.LINFO {
-				fmt.Printf("%s\t%s\t%s\n",
-					mode,
-					pkg.FormatSize(f.UncompressedSize64, concat),
-					p,
-				)
-			}
-			existDir := false
-			if info, err := os.Stat(p); err != nil && !os.IsNotExist(err) {
-				logger.Fatalln(err)
-			} else if err == nil {
-				if info.IsDir() {
-					existDir = true
-					if !mode.IsDir() {
-						logger.Fatalln(p, "is a directory, you should delete it manually")
-					}
-				} else if !overwrite {
-					logger.Fatalln(p, "already exists, you should use --overwrite")
-				}
-
-			}
-			if mode.IsDir() {
-				if !existDir {
-					if err := os.MkdirAll(p, f.Mode()); err != nil {
-						logger.Fatalln(err)
-					}
-				}
-			} else {
-				fr, err := f.Open()
-				if err != nil {
-					logger.Fatalln(err)
-				}
-				fw, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, f.Mode())
-				if err != nil {
-					fr.Close()
-					logger.Fatalln(err)
-				}
-				_, err = io.Copy(fw, fr)
-				fr.Close()
-				fw.Close()
-				if err != nil {
-					logger.Fatalln(err)
-				}
+		if err != nil {
+			if bar != nil {
+				bar.Exit()
+				fmt.Println()
 			}
+			logger.Fatalln(err)
+		}
+		if bar != nil {
+			bar.Finish()
+			fmt.Println()
 		}
 		end := time.Now()
+		if test {
+			logger.Infof("%d entries are verified, no errors", e.entries)
+		}
 		logger.Warnln("total time:", end.Sub(start))
 	},
 }
 
+// open URL, or remote path of spaceship server if isRemote, as ReaderAt by range requests
+func openRemoteArchive(cmd *cobra.Command, name string, isRemote bool) *fetch.ReaderAt {
+	if !isRemote {
+		u, err := url.Parse(name)
+		if err != nil {
+			logger.Fatalln(err)
+		}
+		r, err := newFetcherByFlags(cmd, u.Hostname(), name).NewReaderAt(name, nil)
+		if err != nil {
+			logger.Fatalln(err)
+		}
+		return r
+	}
+	var (
+		serverURL  = viper.GetString(NameServerURL)
+		proxyURL   = viper.GetString(NameProxyURL)
+		insecure   = viper.GetBool(NameInsecureSkipVerify)
+		noRedirect = viper.GetBool(NameDisallowRedirects)
+	)
+	auth, _ := cmd.Flags().GetString("auth")
+	resolveArr, _ := cmd.Flags().GetStringArray("resolve")
+	caPath, _ := cmd.Flags().GetString("cacert")
+	client, err := ship.NewClient(ship.ClientOption{
+		ServerURL: serverURL,
+		FetcherOption: fetch.FetcherOption{
+			InsecureSkipVerify: insecure,
+			DisallowRedirects:  noRedirect,
+			ProxyURL:           proxyURL,
+			ResolveHostMap:     handleResolveHostMap(serverURL, resolveArr...),
+			RootCAs:            handleCACertificate(caPath),
+			LimitRate:          getRateFlag(cmd, "limit-rate"),
+		},
+	})
+	if err != nil {
+		logger.Fatalln(err)
+	}
+	client.SetAuth(handleAuth(auth), true)
+	name = ship.CleanPath(name)
+	logger.Debugln("target url:", client.GetDownloadFileURL(name))
+	r, err := client.OpenReaderAt(name, nil)
+	if err != nil {
+		logger.Fatalln(err)
+	}
+	return r
+}
+
+// uncompressed size of regular zip entries selected by e
+func selectedSize(e *extractor, r *zip.Reader) int64 {
+	var size int64
+	for _, f := range r.File {
+		if !f.Mode().IsRegular() || !e.included(f.Name) {
+			continue
+		}
+		if p, err := e.target(f.Name); err == nil && p != "" && !e.matchExclude(p) {
+			size += int64(f.UncompressedSize64)
+		}
+	}
+	return size
+}
+
+// list entries of tar matching patterns like zip, target of symlink follows its name
+func listTar(format archiveFormat, r io.Reader, patterns []string) error {
+	r, close, err := decompressTar(format, bufio.NewReaderSize(r, 1024*1024))
+	if err != nil {
+		return err
+	}
+	defer close()
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read %s failed: %w", format, err)
+		}
+		if !matchInclude(patterns, header.Name) {
+			continue
+		}
+		name := header.Name
+		if header.Typeflag == tar.TypeSymlink || header.Typeflag == tar.TypeLink {
+			name += " -> " + header.Linkname
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\n",
+			header.FileInfo().Mode(),
+			pkg.FormatSize(header.Size, concat),
+			header.ModTime.Format("2006-01-02 15:04:05"),
+			name,
+		)
+	}
+}
+
 func init() {
 	unzipCmd.Flags().Bool("overwrite", false, "overwrite output file")
-	unzipCmd.Flags().BoolP("list", "l", false, "list files of the specified zip archive")
+	unzipCmd.Flags().BoolP("list", "l", false, "list files of the specified archive")
+	unzipCmd.Flags().BoolP("test", "t", false, "verify CRC32 of zip entries, or checksum of compressed tar, without writing files")
+	unzipCmd.Flags().BoolP("verbose", "v", false, "print every entry instead of a progress bar")
 	unzipCmd.Flags().Bool("all", false, "unarchive all files, the regexp to exclude files will be ignored")
-	unzipCmd.Flags().String("exclude", `node_modules|__pycache__|venv|\.git`, "specify regexp to exclude files, first match the basename, then match the archive path")
+	unzipCmd.Flags().String("exclude", defaultExtractExclude, "specify regexp to exclude files, first match the basename, then match the archive path")
 	unzipCmd.Flags().String("root", "./", "the root directory to unarchive")
+	addExtractPolicyFlags(unzipCmd)
+	addPasswordFlags(unzipCmd, "password of encrypted entries, it is asked if omitted")
+	unzipCmd.Flags().Bool("remote", false, "the archive is a remote path of spaceship server")
+	addSpacestationFlags(unzipCmd)
+	unzipCmd.Flags().StringArrayP("header", "H", []string{}, "header of requests to the archive URL, example: -H \"Cookie:a=1\"")
+	unzipCmd.Flags().String("limit-rate", "0", "limit download rate per second of a remote archive, eg. 500K 5M, 0 means unlimited")
 	rootCmd.AddCommand(unzipCmd)
 }
@@ -1,23 +1,29 @@
 package cmd
 
 import (
+	"archive/tar"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"regexp"
 	"runtime"
-	"spaceship/pkg"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/klauspost/compress/zip"
+	"spaceship/pkg"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
 	"github.com/spf13/cobra"
 )
 
 var zipCmd = &cobra.Command{
 	Use:   "zip",
-	Short: "Archive files with zip",
-	Long:  "Archive files with zip, set log level to WARN to get better compression performance",
+	Short: "Archive files with zip or tar",
+	Long:  "Archive files with zip, tar, tar.gz or tar.zst by --format or extension of output file, set log level to WARN to get better compression performance",
 	Args:  cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 
@@ -25,38 +31,51 @@ var zipCmd = &cobra.Command{
 		output, _ := cmd.Flags().GetString("output")
 		all, _ := cmd.Flags().GetBool("all")
 		overwrite, _ := cmd.Flags().GetBool("overwrite")
+		update, _ := cmd.Flags().GetBool("update")
+		sync, _ := cmd.Flags().GetBool("sync")
+		if sync && !update {
+			logger.Fatalln("--sync can only be used with --update")
+		}
+		formatName, _ := cmd.Flags().GetString("format")
 		rule, _ := cmd.Flags().GetString("exclude")
 		excludeRegexp, err := regexp.Compile(rule)
 		if err != nil {
 			logger.Fatalln(err)
 		}
+		// .gitignore replaces the default regexp to exclude
+		if gitignore, _ := cmd.Flags().GetBool("gitignore"); gitignore && !cmd.Flags().Changed("exclude") {
+			all = true
+		}
 		if all {
 			logger.Debugln("archive all files except output file, the regexp to exclude was ignored")
 		} else {
 			logger.Debugln("regexp to exclude:", excludeRegexp.String())
 		}
+		// files are archived in order of arguments, or sorted if reproducible
 		set := make(map[string]struct{})
+		var roots []string
 		p := ""
 		for i := 0; i < len(args); i++ {
+			matched := []string{filepath.Clean(args[i])}
 			if glob {
-				matched, _ := filepath.Glob(args[0])
-				for _, v := range matched {
-					if p == "" {
-						p = v
-					}
-					set[v] = struct{}{}
-				}
-			} else {
-				v := filepath.Clean(args[i])
-				set[v] = struct{}{}
+				matched, _ = filepath.Glob(args[i])
+			}
+			for _, v := range matched {
 				if p == "" {
 					p = v
 				}
+				if _, ok := set[v]; !ok {
+					set[v] = struct{}{}
+					roots = append(roots, v)
+				}
 			}
 		}
 		if len(set) == 0 {
 			logger.Fatalln("no files")
 		}
+		if reproducible, _ := cmd.Flags().GetBool("reproducible"); reproducible {
+			sort.Strings(roots)
+		}
 		if output == "" {
 			v, err := filepath.Abs(p)
 			if err != nil {
@@ -66,37 +85,78 @@ var zipCmd = &cobra.Command{
 			if output == "" {
 				logger.Fatalln("cannot get output file name")
 			}
-			if !strings.HasSuffix(output, ".zip") {
-				output += ".zip"
+			if formatName == "" {
+				formatName = formatZip.String()
+			}
+			if !strings.HasSuffix(output, "."+formatName) {
+				output += "." + formatName
 			}
 			logger.Infoln("auto specify output file:", output)
 
 		} else {
 			output = filepath.Clean(output)
 		}
+		format := archiveFormatOf(output)
+		if formatName != "" {
+			if format = archiveFormatByName(formatName); format == formatUnknown {
+				logger.Fatalln("invalid --format", formatName)
+			}
+		}
+		if format == formatTarXz {
+			logger.Fatalln("tar.xz can only be extracted, use tar.zst or tar.gz instead")
+		}
+		logger.Debugln("archive format:", format)
+		if update && format != formatZip {
+			logger.Fatalln("only zip can be updated")
+		}
+		option := archiveOptionByFlags(cmd, format)
 		absOutput, err := filepath.Abs(output)
 		if err != nil {
 			logger.Fatalln(err)
 		}
+		// mode of the updated zip is kept
+		perm := os.FileMode(0644)
 		if info, err := os.Stat(output); err != nil {
 			if !os.IsNotExist(err) {
 				logger.Fatalln(err)
 			}
 		} else if info.IsDir() {
 			logger.Fatalln(output, "is a directory")
+		} else if update {
+			perm = info.Mode().Perm()
+			if option.update, err = openZipUpdate(output, sync); err != nil {
+				logger.Fatalln(err)
+			}
+			defer option.update.Close()
 		} else if overwrite {
 			logger.Warnln("overwrite output file")
 		} else {
-			logger.Fatalln(output, "already exists, you should use --overwrite")
+			logger.Fatalln(output, "already exists, you should use --overwrite or --update")
+		}
+		var f *os.File
+		if option.update != nil {
+			// the updated zip is replaced only after the new one is written completely
+			f, err = os.CreateTemp(filepath.Dir(output), "."+filepath.Base(output)+".*")
+			if err == nil {
+				err = f.Chmod(perm)
+			}
+		} else {
+			f, err = os.Create(output)
+		}
+		if err != nil {
+			logger.Fatalln(err)
 		}
-		f, err := os.Create(output)
+		absTemp, err := filepath.Abs(f.Name())
 		if err != nil {
 			logger.Fatalln(err)
 		}
 		var fatalErr error
-		zipWriter := zip.NewWriter(f)
+		archive, err := newArchiveWriter(format, f, option)
+		if err != nil {
+			logger.Fatalln(err)
+		}
 		start := time.Now()
-		for p := range set {
+		for _, p := range roots {
 			root := filepath.Base(p)
 			// if p is "..", then root is ".." and archive path starts with "..", so we need get real name of ".."
 			if root == ".." {
@@ -107,7 +167,7 @@ var zipCmd = &cobra.Command{
 					root = filepath.Base(filepath.Dir(d))
 				}
 			}
-			// logger.Fatalln(root)
+			ignore := newIgnoreMatcherByFlags(cmd, p)
 			fatalErr = filepath.Walk(p, func(path string, info os.FileInfo, err error) error {
 				if err != nil {
 					return err
@@ -116,10 +176,21 @@ var zipCmd = &cobra.Command{
 				if err != nil {
 					return err
 				}
-				if absPath == absOutput {
+				if absPath == absOutput || absPath == absTemp {
 					logger.Warnln("skip", path, "because it's output file")
 					return nil
 				}
+				if ignore != nil && path != p {
+					if ignored, err := ignore.ignored(path, info.IsDir()); err != nil {
+						return err
+					} else if ignored {
+						logger.Infoln("skip", path, "because it is ignored")
+						if info.IsDir() {
+							return filepath.SkipDir
+						}
+						return nil
+					}
+				}
 				relPath, err := filepath.Rel(p, path)
 				if err != nil {
 					return err
@@ -138,59 +209,330 @@ var zipCmd = &cobra.Command{
 				}
 				logger.Infoln(path, "=>", archivePath)
 
-				header, err := zip.FileInfoHeader(info)
-				if err != nil {
-					return err
-				}
-				header.Name = archivePath
-				if info.IsDir() {
-					header.Name += "/" // required - strangely no mention of this in zip spec? but is in godoc...
-					header.Method = zip.Store
-					_, err = zipWriter.CreateHeader(header)
-					return err
-				}
-				header.Method = zip.Deflate
-				writer, err := zipWriter.CreateHeader(header)
-				if err != nil {
-					return err
-				}
-				file, err := os.Open(path)
-				if err != nil {
-					return err
-				}
-				defer file.Close()
-				_, err = io.Copy(writer, file)
-				return err
+				return archive.add(path, archivePath, info)
 			})
 			if fatalErr != nil {
 				break
 			}
 		}
-		zipWriter.Close()
+		if err := archive.Close(); err != nil && fatalErr == nil {
+			fatalErr = err
+		}
 		end := time.Now()
 		defer f.Close()
+		if fatalErr == nil && option.update != nil {
+			if fatalErr = f.Close(); fatalErr == nil {
+				fatalErr = os.Rename(f.Name(), output)
+			}
+		}
 		if fatalErr != nil {
 			os.Remove(f.Name())
 			logger.Fatalln(fatalErr)
 		} else {
+			if u := option.update; u != nil {
+				logger.Infof("%d entries kept, %d updated, %d added, %d deleted", u.kept, u.updated, u.added, u.deleted)
+			}
 			duration := end.Sub(start)
-			info, err := f.Stat()
+			info, err := os.Stat(output)
 			var v string
 			if err != nil {
 				v = err.Error()
 			} else {
 				v = pkg.FormatSize(info.Size())
 			}
-			logger.Warnf("total time: %s  %s size: %s", duration, f.Name(), v)
+			logger.Warnf("total time: %s  %s size: %s", duration, output, v)
 		}
 	},
 }
 
+// archiveWriter adds files to archive of zip or tar formats
+type archiveWriter interface {
+	// add file at name as archivePath, info is got by lstat
+	add(name string, archivePath string, info os.FileInfo) error
+	Close() error
+}
+
+// options of creating archive
+type archiveOption struct {
+	// keep uid and gid in tar
+	sameOwner bool
+	// compression level of method, -1 for default
+	level int
+	// method of zip entries, deflate zstd or store
+	method string
+	// extensions of files stored in zip without compression, in lower case without dot
+	storeExt map[string]bool
+	// number of goroutines compressing zip entries
+	concurrency int
+	// entries of zip are encrypted by AES-256 if it is not empty
+	password string
+	// existing zip of --update, nil if a new archive is created
+	update *zipUpdate
+	// entries have modTime, normalized permissions and no extra field, so the same files make the same archive
+	reproducible bool
+	modTime      time.Time
+}
+
+func newArchiveWriter(format archiveFormat, w io.Writer, option *archiveOption) (archiveWriter, error) {
+	var compressor io.WriteCloser
+	switch format {
+	case formatZip:
+		return newZipArchiveWriter(w, option)
+	case formatTar:
+	case formatTarGzip:
+		level := option.level
+		if level < 0 {
+			level = gzip.DefaultCompression
+		}
+		gw, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, err
+		}
+		compressor = gw
+	case formatTarZstd:
+		options := []zstd.EOption{zstdLevel(option.level)}
+		if option.reproducible {
+			// output of concurrent encoding may differ
+			options = append(options, zstd.WithEncoderConcurrency(1))
+		}
+		encoder, err := zstd.NewWriter(w, options...)
+		if err != nil {
+			return nil, err
+		}
+		compressor = encoder
+	default:
+		return nil, fmt.Errorf("archive of %s can't be created", format)
+	}
+	t := &tarArchiveWriter{compressor: compressor, sameOwner: option.sameOwner}
+	if option.reproducible {
+		t.modTime = &option.modTime
+	}
+	if compressor != nil {
+		w = compressor
+	}
+	t.w = tar.NewWriter(w)
+	return t, nil
+}
+
+// format by extension of name, zip if it is unknown
+func archiveFormatOf(name string) archiveFormat {
+	name = strings.ToLower(name)
+	for _, format := range []archiveFormat{formatTar, formatTarGzip, formatTarZstd, formatTarXz} {
+		if strings.HasSuffix(name, "."+format.String()) {
+			return format
+		}
+	}
+	switch {
+	case strings.HasSuffix(name, ".tgz"):
+		return formatTarGzip
+	case strings.HasSuffix(name, ".tzst"):
+		return formatTarZstd
+	case strings.HasSuffix(name, ".txz"):
+		return formatTarXz
+	}
+	return formatZip
+}
+
+// format named like "tar.gz", formatUnknown if name is invalid
+func archiveFormatByName(name string) archiveFormat {
+	for _, format := range []archiveFormat{formatTar, formatTarGzip, formatTarZstd, formatTarXz, formatZip} {
+		if name == format.String() {
+			return format
+		}
+	}
+	return formatUnknown
+}
+
+// tarArchiveWriter keeps modes, modification times and symlinks, uid and gid are kept if sameOwner
+type tarArchiveWriter struct {
+	w *tar.Writer
+	// nil for tar
+	compressor io.WriteCloser
+	sameOwner  bool
+	// time of all entries whose permissions are normalized too, nil if they are kept
+	modTime *time.Time
+}
+
+func (t *tarArchiveWriter) add(name string, archivePath string, info os.FileInfo) error {
+	var link string
+	switch mode := info.Mode(); {
+	case mode.IsRegular(), mode.IsDir():
+	case mode&os.ModeSymlink != 0:
+		var err error
+		if link, err = os.Readlink(name); err != nil {
+			return err
+		}
+	default:
+		logger.Warnln("skip", name, "because it is not a regular file, directory or symlink")
+		return nil
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = archivePath
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	// access and change times would require PAX records
+	header.AccessTime, header.ChangeTime = time.Time{}, time.Time{}
+	if !t.sameOwner {
+		header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+	}
+	if t.modTime != nil {
+		header.ModTime = *t.modTime
+		header.Mode = int64(normalizedMode(info.Mode()).Perm())
+	}
+	if err := t.w.WriteHeader(header); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	// the size written in header is kept even if the file grows
+	_, err = io.CopyN(t.w, file, header.Size)
+	return err
+}
+
+func (t *tarArchiveWriter) Close() error {
+	err := t.w.Close()
+	if t.compressor != nil {
+		if closeErr := t.compressor.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// default extensions of files which are compressed already
+const defaultStoreExt = "jpg,jpeg,png,gif,webp,heic,mp3,aac,ogg,flac,mp4,mkv,mov,avi,webm,zip,gz,tgz,bz2,xz,txz,zst,tzst,7z,rar,jar,apk,docx,xlsx,pptx,woff2"
+
+// --method is used only by zip, the level is checked by compression of format
+func archiveOptionByFlags(cmd *cobra.Command, format archiveFormat) *archiveOption {
+	sameOwner, _ := cmd.Flags().GetBool("same-owner")
+	level, _ := cmd.Flags().GetInt("compression-level")
+	method, _ := cmd.Flags().GetString("method")
+	storeExt, _ := cmd.Flags().GetStringSlice("store-ext")
+	concurrency, _ := cmd.Flags().GetInt("concurrency")
+	option := &archiveOption{
+		sameOwner:   sameOwner,
+		level:       level,
+		method:      method,
+		storeExt:    make(map[string]bool),
+		concurrency: concurrency,
+	}
+	switch method {
+	case zipMethodDeflate, zipMethodZstd, zipMethodStore:
+	default:
+		logger.Fatalf("invalid --method %s, it should be deflate, zstd or store", method)
+	}
+	compression := method
+	switch format {
+	case formatTarGzip:
+		compression = zipMethodDeflate
+	case formatTarZstd:
+		compression = zipMethodZstd
+	}
+	switch compression {
+	case zipMethodDeflate:
+		if level > 9 {
+			logger.Fatalln("--compression-level of deflate should be between 0 and 9")
+		}
+	case zipMethodZstd:
+		if level > 22 {
+			logger.Fatalln("--compression-level of zstd should be between 1 and 22")
+		}
+	}
+	if option.reproducible, _ = cmd.Flags().GetBool("reproducible"); option.reproducible {
+		if sameOwner {
+			logger.Fatalln("--same-owner can't be used with --reproducible")
+		}
+		option.modTime = reproducibleTime()
+		// the default of compression library may change
+		if option.level < 0 {
+			option.level = 6
+			if compression == zipMethodZstd {
+				option.level = 3
+			}
+		}
+		logger.Debugf("reproducible time: %s  level: %d", option.modTime, option.level)
+	}
+	option.password = passwordOfFlags(cmd)
+	if encrypt, _ := cmd.Flags().GetBool("encrypt"); encrypt && option.password == "" {
+		password, err := readPassword("Please input password: ", true)
+		if err != nil {
+			logger.Fatalln(err)
+		}
+		option.password = password
+	}
+	if option.password != "" && format != formatZip {
+		logger.Fatalln("only zip can be encrypted")
+	}
+	if option.password != "" && option.reproducible {
+		logger.Fatalln("encrypted zip can't be reproducible, its salt is random")
+	}
+	for _, ext := range storeExt {
+		if ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), ".")); ext != "" {
+			option.storeExt[ext] = true
+		}
+	}
+	if option.concurrency < 1 {
+		option.concurrency = 1
+	}
+	logger.Debugf("method: %s  level: %d  concurrency: %d  store extensions: %v", method, level, option.concurrency, storeExt)
+	return option
+}
+
+// time of entries in reproducible archive, SOURCE_DATE_EPOCH if it is set, otherwise 1980-01-01 00:00:00 UTC,
+// the earliest time of zip
+func reproducibleTime() time.Time {
+	min := time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+	epoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if epoch == "" {
+		return min
+	}
+	seconds, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		logger.Fatalln("invalid SOURCE_DATE_EPOCH:", err)
+	}
+	t := time.Unix(seconds, 0).UTC()
+	if t.Before(min) {
+		return min
+	}
+	return t
+}
+
+// 0755 for directories and executables, 0644 for other files, type bits are kept
+func normalizedMode(mode os.FileMode) os.FileMode {
+	perm := os.FileMode(0644)
+	if mode.IsDir() || mode&0111 != 0 {
+		perm = 0755
+	}
+	return mode&os.ModeType | perm
+}
+
 func init() {
 	zipCmd.Flags().Bool("overwrite", false, "overwrite output file")
+	zipCmd.Flags().Bool("update", false, "update existing zip, entries of unchanged files are copied without recompression, changed and new files are compressed")
+	zipCmd.Flags().Bool("sync", false, "delete entries of files which don't exist any more when using --update")
 	zipCmd.Flags().StringP("output", "o", "", "output file")
+	zipCmd.Flags().String("format", "", "archive format, zip tar tar.gz or tar.zst, it is detected by extension of output file if omitted")
+	zipCmd.Flags().Bool("same-owner", false, "keep uid and gid of files in tar, they are 0 if omitted")
+	zipCmd.Flags().String("method", zipMethodDeflate, "compression method of zip entries, deflate zstd or store, zstd requires 7-Zip or WinZip to extract")
+	zipCmd.Flags().Int("compression-level", -1, "compression level, 0-9 for deflate and gzip, 1-22 for zstd, -1 means default")
+	zipCmd.Flags().StringSlice("store-ext", strings.Split(defaultStoreExt, ","), "extensions of files stored in zip without compression since they are compressed already")
+	zipCmd.Flags().IntP("concurrency", "c", runtime.NumCPU(), "number of goroutines compressing zip entries")
+	zipCmd.Flags().Bool("encrypt", false, "encrypt entries by AES-256 with password asked from terminal, it can be opened by 7-Zip and WinZip")
+	addPasswordFlags(zipCmd, "encrypt entries by AES-256 with password")
 	zipCmd.Flags().Bool("glob", false, "use glob pattern")
 	zipCmd.Flags().Bool("all", false, "archive all files except output file, the regexp to exclude files will be ignored")
-	zipCmd.Flags().String("exclude", `^(node_modules|__pycache__|venv|\.git)$`, "specify regexp to exclude files, first match the basename, then match the archive path")
+	zipCmd.Flags().String("exclude", `^(node_modules|__pycache__|venv|\.git)$`, "specify regexp to exclude files, first match the basename, then match the archive path, the default is not used with --gitignore")
+	addIgnoreFlags(zipCmd)
+	zipCmd.Flags().Bool("reproducible", false, "make the same archive from the same files, entries are sorted, their time is SOURCE_DATE_EPOCH or 1980-01-01, permissions are 0644 or 0755, and zip entries have no extra field")
 	rootCmd.AddCommand(zipCmd)
 }
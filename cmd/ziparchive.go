@@ -0,0 +1,447 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/zip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// compression methods of zip entries
+const (
+	zipMethodDeflate = "deflate"
+	zipMethodZstd    = "zstd"
+	zipMethodStore   = "store"
+)
+
+// Info-ZIP extended timestamp extra field
+const zipExtraExtendedTime = 0x5455
+
+// versions needed to extract of APPNOTE, CreateRaw doesn't set them like CreateHeader
+const (
+	zipVersionDeflate = 20
+	zipVersionZip64   = 45
+	zipVersionZstd    = 63
+)
+
+// files larger than it are compressed to temporary files instead of memory
+const zipMemoryLimit = 1024 * 1024
+
+func init() {
+	// zstd entries written by 7-Zip and WinZip, or by older PKWARE tools
+	zip.RegisterDecompressor(zstd.ZipMethodWinZip, zstd.ZipDecompressor())
+	zip.RegisterDecompressor(zstd.ZipMethodPKWare, zstd.ZipDecompressor())
+}
+
+func zstdLevel(level int) zstd.EOption {
+	if level < 0 {
+		return zstd.WithEncoderLevel(zstd.SpeedDefault)
+	}
+	return zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level))
+}
+
+// zipArchiveWriter compresses files by several goroutines, compressed entries are written to zip in order of add
+type zipArchiveWriter struct {
+	w      *zip.Writer
+	option *archiveOption
+	// entries to compress
+	jobs chan *zipEntry
+	// entries in order of add, the capacity limits entries compressed ahead
+	queue   chan *zipEntry
+	workers sync.WaitGroup
+	// closed when all entries are written
+	written chan struct{}
+	l       sync.Mutex
+	err     error
+}
+
+// entry compressed into memory or a temporary file, or an entry of the updated zip copied as it is
+type zipEntry struct {
+	name   string
+	header *zip.FileHeader
+	buf    bytes.Buffer
+	temp   *os.File
+	raw    *zip.File
+	// target of symlink, it is the content of the entry
+	link string
+	// receives result of compression, nil for entries without content
+	done chan error
+}
+
+func newZipArchiveWriter(w io.Writer, option *archiveOption) (*zipArchiveWriter, error) {
+	z := &zipArchiveWriter{
+		w:       zip.NewWriter(w),
+		option:  option,
+		jobs:    make(chan *zipEntry, option.concurrency),
+		queue:   make(chan *zipEntry, option.concurrency*2),
+		written: make(chan struct{}),
+	}
+	for i := 0; i < option.concurrency; i++ {
+		z.workers.Add(1)
+		go func() {
+			defer z.workers.Done()
+			for entry := range z.jobs {
+				entry.done <- z.compress(entry)
+			}
+		}()
+	}
+	go z.writeLoop()
+	return z, nil
+}
+
+func (z *zipArchiveWriter) setErr(err error) {
+	z.l.Lock()
+	defer z.l.Unlock()
+	if z.err == nil {
+		z.err = err
+	}
+}
+
+func (z *zipArchiveWriter) getErr() error {
+	z.l.Lock()
+	defer z.l.Unlock()
+	return z.err
+}
+
+func (z *zipArchiveWriter) add(name string, archivePath string, info os.FileInfo) error {
+	if err := z.getErr(); err != nil {
+		return err
+	}
+	var link string
+	switch mode := info.Mode(); {
+	case mode.IsRegular(), mode.IsDir():
+	case mode&os.ModeSymlink != 0:
+		var err error
+		if link, err = os.Readlink(name); err != nil {
+			return err
+		}
+	default:
+		logger.Warnln("skip", name, "because it is not a regular file, directory or symlink")
+		return nil
+	}
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = archivePath
+	// names are always UTF-8, otherwise readers guess charset of non-ASCII names
+	header.Flags |= zipFlagUTF8
+	if z.option.reproducible {
+		// CreateHeader adds extended timestamp if Modified is set, so only the MS-DOS time is set
+		header.Modified = time.Time{}
+		header.ModifiedDate, header.ModifiedTime = msDosTime(z.option.modTime)
+		header.SetMode(normalizedMode(info.Mode()))
+	}
+	entry := &zipEntry{name: name, header: header, link: link}
+	if info.IsDir() {
+		header.Name += "/" // required - strangely no mention of this in zip spec? but is in godoc...
+		header.Method = zip.Store
+		if z.option.update != nil {
+			z.option.update.visit(header.Name)
+		}
+		z.queue <- entry
+		return nil
+	}
+	if u := z.option.update; u != nil {
+		if entry.raw = u.unchanged(archivePath, info, z.option.password); entry.raw != nil {
+			z.queue <- entry
+			return nil
+		}
+	}
+	// CreateRaw doesn't add extended timestamp like CreateHeader, without it only the MS-DOS time is kept
+	if !z.option.reproducible {
+		header.Extra = append(header.Extra, extendedTimeExtra(header.Modified)...)
+	}
+	entry.done = make(chan error, 1)
+	z.queue <- entry
+	z.jobs <- entry
+	return nil
+}
+
+// compress content of entry and fill sizes and CRC32 of its header
+func (z *zipArchiveWriter) compress(entry *zipEntry) error {
+	header := entry.header
+	method := z.option.method
+	if z.option.storeExt[strings.ToLower(strings.TrimPrefix(filepath.Ext(entry.name), "."))] {
+		method = zipMethodStore
+	}
+	var content io.Reader
+	if header.Mode()&os.ModeSymlink != 0 {
+		// the target is stored like Info-ZIP, readers take the content as the target
+		method = zipMethodStore
+		content = strings.NewReader(entry.link)
+	} else {
+		file, err := os.Open(entry.name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		content = file
+	}
+	var err error
+	var out io.Writer = &entry.buf
+	if header.UncompressedSize64 > zipMemoryLimit {
+		if entry.temp, err = os.CreateTemp("", "spaceship-zip-*"); err != nil {
+			return err
+		}
+		// removed on close, unless the system doesn't allow it
+		os.Remove(entry.temp.Name())
+		out = entry.temp
+	}
+	counter := &countWriter{w: out}
+	// compressed data is encrypted if there is password
+	var encrypted io.Writer = counter
+	var encrypter *aesWriter
+	if z.option.password != "" {
+		if encrypter, err = newAESWriter(counter, z.option.password); err != nil {
+			return err
+		}
+		encrypted = encrypter
+	}
+	var compressor io.WriteCloser
+	switch method {
+	case zipMethodStore:
+		header.Method = zip.Store
+	case zipMethodZstd:
+		header.Method = zstd.ZipMethodWinZip
+		if compressor, err = zstd.NewWriter(encrypted, zstdLevel(z.option.level), zstd.WithEncoderConcurrency(1)); err != nil {
+			return err
+		}
+	default:
+		header.Method = zip.Deflate
+		level := z.option.level
+		if level < 0 {
+			level = flate.DefaultCompression
+		}
+		if compressor, err = flate.NewWriter(encrypted, level); err != nil {
+			return err
+		}
+	}
+	crc := crc32.NewIEEE()
+	w := io.MultiWriter(encrypted, crc)
+	if compressor != nil {
+		w = io.MultiWriter(compressor, crc)
+	}
+	n, err := io.Copy(w, content)
+	if err != nil {
+		return err
+	}
+	if compressor != nil {
+		if err := compressor.Close(); err != nil {
+			return err
+		}
+	}
+	header.CRC32 = crc.Sum32()
+	header.UncompressedSize64 = uint64(n)
+	if encrypter != nil {
+		if err := encrypter.Close(); err != nil {
+			return err
+		}
+		// AE-2 keeps CRC32 0, the content is verified by the authentication code
+		header.Extra = append(header.Extra, aesExtra(header.Method)...)
+		header.Method = zipMethodAES
+		header.Flags |= zipFlagEncrypted
+		header.CRC32 = 0
+		header.ReaderVersion = zipVersionAES
+	}
+	header.CompressedSize64 = uint64(counter.n)
+	var version uint16 = zipVersionDeflate
+	if method == zipMethodZstd {
+		version = zipVersionZstd
+	}
+	if header.CompressedSize64 >= math.MaxUint32 || header.UncompressedSize64 >= math.MaxUint32 {
+		version = max(version, zipVersionZip64)
+	}
+	setZipVersion(header, version)
+	return nil
+}
+
+// raise version needed to extract of header to version, version made by follows it and keeps the host system
+func setZipVersion(header *zip.FileHeader, version uint16) {
+	header.ReaderVersion = max(header.ReaderVersion, version)
+	header.CreatorVersion = header.CreatorVersion&0xff00 | header.ReaderVersion
+}
+
+// write entries in order, entries are drained after an error so that add never blocks
+func (z *zipArchiveWriter) writeLoop() {
+	defer close(z.written)
+	for entry := range z.queue {
+		err := z.getErr()
+		if entry.done != nil {
+			if compressErr := <-entry.done; err == nil {
+				err = compressErr
+			}
+		}
+		if err == nil {
+			err = z.write(entry)
+		}
+		if entry.temp != nil {
+			entry.temp.Close()
+			os.Remove(entry.temp.Name())
+		}
+		if err != nil {
+			z.setErr(err)
+		}
+	}
+}
+
+func (z *zipArchiveWriter) write(entry *zipEntry) error {
+	if entry.raw != nil {
+		logger.Debugf("%s is copied from the updated zip", entry.raw.Name)
+		return z.w.Copy(entry.raw)
+	}
+	if entry.done == nil {
+		_, err := z.w.CreateHeader(entry.header)
+		return err
+	}
+	logger.Debugf("%s compressed to %d bytes", entry.header.Name, entry.header.CompressedSize64)
+	w, err := z.w.CreateRaw(entry.header)
+	if err != nil {
+		return err
+	}
+	if entry.temp == nil {
+		_, err = entry.buf.WriteTo(w)
+		return err
+	}
+	if _, err := entry.temp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, entry.temp)
+	return err
+}
+
+func (z *zipArchiveWriter) Close() error {
+	if u := z.option.update; u != nil && z.getErr() == nil {
+		for _, f := range u.rest() {
+			z.queue <- &zipEntry{raw: f}
+		}
+	}
+	close(z.jobs)
+	close(z.queue)
+	z.workers.Wait()
+	<-z.written
+	if err := z.getErr(); err != nil {
+		return err
+	}
+	return z.w.Close()
+}
+
+// zipUpdate is the existing zip of --update, entries of unchanged files are copied without recompression,
+// entries of files not added are kept, or deleted if sync
+type zipUpdate struct {
+	r       *zip.ReadCloser
+	entries map[string]*zip.File
+	visited map[string]bool
+	sync    bool
+	// counts of entries for the summary
+	kept, updated, added, deleted int
+}
+
+func openZipUpdate(name string, sync bool) (*zipUpdate, error) {
+	r, err := zip.OpenReader(name)
+	if err != nil {
+		return nil, err
+	}
+	u := &zipUpdate{r: r, entries: make(map[string]*zip.File), visited: make(map[string]bool), sync: sync}
+	for _, f := range r.File {
+		u.entries[f.Name] = f
+	}
+	return u, nil
+}
+
+func (u *zipUpdate) visit(name string) {
+	u.visited[name] = true
+}
+
+// entry of archivePath if the file isn't changed since it was added, by size, modification time and mode,
+// an entry is changed too if it isn't encrypted by password, or it is encrypted but password is empty
+func (u *zipUpdate) unchanged(archivePath string, info os.FileInfo, password string) *zip.File {
+	u.visit(archivePath)
+	f, ok := u.entries[archivePath]
+	if !ok {
+		logger.Debugln("add", archivePath)
+		u.added++
+		return nil
+	}
+	if f.UncompressedSize64 != uint64(info.Size()) || f.Modified.Unix() != info.ModTime().Unix() ||
+		f.Mode() != info.Mode() || !encryptedBy(f, password) {
+		logger.Debugln("update", archivePath)
+		u.updated++
+		return nil
+	}
+	u.kept++
+	return f
+}
+
+// whether f is encrypted by password, or neither is encrypted, the password is checked by the verifier of f
+func encryptedBy(f *zip.File, password string) bool {
+	if f.Flags&zipFlagEncrypted == 0 || password == "" {
+		return f.Flags&zipFlagEncrypted == 0 && password == ""
+	}
+	r, err := openZipEntry(f, func() (string, error) { return password, nil })
+	if err != nil {
+		return false
+	}
+	r.Close()
+	return true
+}
+
+// entries of files not added in order of the zip, nil if sync
+func (u *zipUpdate) rest() []*zip.File {
+	var files []*zip.File
+	for _, f := range u.r.File {
+		if u.visited[f.Name] {
+			continue
+		}
+		if u.sync {
+			logger.Infoln("delete", f.Name)
+			u.deleted++
+		} else {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+func (u *zipUpdate) Close() error {
+	return u.r.Close()
+}
+
+// extended timestamp extra field of Info-ZIP with modification time only
+func extendedTimeExtra(t time.Time) []byte {
+	extra := make([]byte, 9)
+	binary.LittleEndian.PutUint16(extra, zipExtraExtendedTime)
+	binary.LittleEndian.PutUint16(extra[2:], 5)
+	extra[4] = 1
+	binary.LittleEndian.PutUint32(extra[5:], uint32(t.Unix()))
+	return extra
+}
+
+// date and time of t in MS-DOS format, in 2 seconds precision
+func msDosTime(t time.Time) (date uint16, clock uint16) {
+	date = uint16(t.Day() + int(t.Month())<<5 + (t.Year()-1980)<<9)
+	clock = uint16(t.Second()/2 + t.Minute()<<5 + t.Hour()<<11)
+	return
+}
+
+// counts bytes written to w
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,197 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/klauspost/compress/zip"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// names and comments of entries with the flag are UTF-8
+const zipFlagUTF8 = 0x800
+
+// Info-ZIP Unicode Path extra field, it keeps UTF-8 name of an entry whose name is in a local charset
+const zipExtraUnicodePath = 0x7075
+
+// charsets tried when names of entries without UTF-8 flag are detected, the one with highest score wins
+var zipCharsets = []struct {
+	name     string
+	encoding encoding.Encoding
+	// score of name, false if name is invalid in the charset
+	score func(name string) (int, bool)
+}{
+	{"gbk", simplifiedchinese.GBK, gbkScore},
+	{"shift_jis", japanese.ShiftJIS, shiftJISScore},
+}
+
+// score of GBK name, common characters of GB2312 get higher score
+func gbkScore(name string) (int, bool) {
+	score := 0
+	for i := 0; i < len(name); {
+		c := name[i]
+		if c < 0x80 {
+			i++
+			continue
+		}
+		if c == 0x80 || c == 0xff || i+1 >= len(name) {
+			return 0, false
+		}
+		t := name[i+1]
+		if t < 0x40 || t == 0x7f || t == 0xff {
+			return 0, false
+		}
+		switch {
+		case c >= 0xb0 && c <= 0xd7 && t >= 0xa1:
+			// level 1 hanzi
+			score += 2
+		case c >= 0xa1 && c <= 0xf7 && t >= 0xa1:
+			score++
+		}
+		i += 2
+	}
+	return score, true
+}
+
+// score of Shift-JIS name, kana and level 1 kanji get higher score, half-width katakana gets none
+// because common GBK characters look like them
+func shiftJISScore(name string) (int, bool) {
+	score := 0
+	for i := 0; i < len(name); {
+		c := name[i]
+		if c < 0x80 || (c >= 0xa1 && c <= 0xdf) {
+			i++
+			continue
+		}
+		if c < 0x81 || (c > 0x9f && c < 0xe0) || c > 0xfc || i+1 >= len(name) {
+			return 0, false
+		}
+		t := name[i+1]
+		if t < 0x40 || t == 0x7f || t > 0xfc {
+			return 0, false
+		}
+		switch {
+		case c == 0x82 || c == 0x83 || (c >= 0x88 && c <= 0x98):
+			score += 2
+		case c == 0x81:
+			score++
+		}
+		i += 2
+	}
+	return score, true
+}
+
+// encoding of charset name like gbk shift_jis cp437
+func encodingByName(name string) (encoding.Encoding, error) {
+	if e, err := htmlindex.Get(name); err == nil {
+		return e, nil
+	}
+	e, err := ianaindex.IANA.Encoding(name)
+	if err != nil || e == nil {
+		return nil, fmt.Errorf("unsupported charset %s", name)
+	}
+	return e, nil
+}
+
+// detect charset of names, UTF-8 is kept if all names are valid, CP437 of the zip spec is used if no charset fits
+func detectCharset(names []string) (string, encoding.Encoding) {
+	valid := true
+	for _, name := range names {
+		valid = valid && utf8.ValidString(name)
+	}
+	if valid {
+		return "utf-8", unicode.UTF8
+	}
+	best, bestScore := -1, -1
+	for i, charset := range zipCharsets {
+		total := 0
+		for _, name := range names {
+			score, ok := charset.score(name)
+			if !ok {
+				total = -1
+				break
+			}
+			total += score
+		}
+		if total > bestScore {
+			best, bestScore = i, total
+		}
+	}
+	if best < 0 {
+		return "cp437", charmap.CodePage437
+	}
+	return zipCharsets[best].name, zipCharsets[best].encoding
+}
+
+// UTF-8 name of Unicode Path extra field, it is ignored if the name was changed after the field was written
+func unicodePathOf(f *zip.File) (string, bool) {
+	for extra := f.Extra; len(extra) >= 4; {
+		tag := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			return "", false
+		}
+		data := extra[4 : 4+size]
+		extra = extra[4+size:]
+		// version 1, CRC32 of the name, then UTF-8 name
+		if tag != zipExtraUnicodePath || size < 5 || data[0] != 1 {
+			continue
+		}
+		if binary.LittleEndian.Uint32(data[1:]) != crc32.ChecksumIEEE([]byte(f.Name)) || !utf8.Valid(data[5:]) {
+			return "", false
+		}
+		return string(data[5:]), true
+	}
+	return "", false
+}
+
+// decode names of entries without UTF-8 flag by charset, it is detected by all these names if charset is empty
+func decodeZipNames(r *zip.Reader, charset string) error {
+	var files []*zip.File
+	var names []string
+	for _, f := range r.File {
+		if !f.NonUTF8 {
+			continue
+		}
+		if name, ok := unicodePathOf(f); ok {
+			f.Name, f.NonUTF8 = name, false
+			continue
+		}
+		files = append(files, f)
+		names = append(names, f.Name)
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	var e encoding.Encoding
+	if charset == "" {
+		charset, e = detectCharset(names)
+		logger.Debugf("charset of %d names without UTF-8 flag is detected as %s", len(names), charset)
+	} else {
+		var err error
+		if e, err = encodingByName(charset); err != nil {
+			return err
+		}
+	}
+	decoder := e.NewDecoder()
+	for _, f := range files {
+		name, err := decoder.String(f.Name)
+		if err != nil {
+			return fmt.Errorf("decode name %q by %s failed: %w", f.Name, charset, err)
+		}
+		if strings.ContainsRune(name, utf8.RuneError) {
+			return fmt.Errorf("name %q is not %s, you may specify --charset", f.Name, charset)
+		}
+		f.Name, f.NonUTF8 = name, false
+	}
+	return nil
+}
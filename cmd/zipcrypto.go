@@ -0,0 +1,382 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/zip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Encryption of zip entries, WinZip AES (AE-1 and AE-2) and the traditional PKWARE encryption known as ZipCrypto.
+// See https://www.winzip.com/en/support/aes-encryption/ and APPNOTE.TXT section 6.1
+
+var errWrongPassword = errors.New("wrong password")
+
+const (
+	// method of AES encrypted entries, the actual method is in the extra field
+	zipMethodAES = 99
+	// header ID of the extra field of AES
+	zipExtraAES = 0x9901
+	// version needed to extract of AES encrypted entries
+	zipVersionAES = 51
+	// length of the authentication code
+	aesMACSize = 10
+	// flag of encrypted entries
+	zipFlagEncrypted = 0x1
+	// flag of entries whose CRC32 and sizes are in data descriptor
+	zipFlagDataDescriptor = 0x8
+	// flag of strong encryption which is not supported
+	zipFlagStrongEncryption = 0x40
+)
+
+// PBKDF2 with HMAC-SHA1 of RFC 8018
+func pbkdf2SHA1(password []byte, salt []byte, iterations int, keyLen int) []byte {
+	prf := hmac.New(sha1.New, password)
+	hashLen := prf.Size()
+	blocks := (keyLen + hashLen - 1) / hashLen
+	key := make([]byte, 0, blocks*hashLen)
+	u := make([]byte, hashLen)
+	var index [4]byte
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(index[:], uint32(block))
+		prf.Write(index[:])
+		key = prf.Sum(key)
+		t := key[len(key)-hashLen:]
+		copy(u, t)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			subtle.XORBytes(t, t, u)
+		}
+	}
+	return key[:keyLen]
+}
+
+// keys of WinZip AES derived from password and salt, the key size is 16, 24 or 32
+func aesKeys(password string, salt []byte, keySize int) (aesKey, macKey, verifier []byte) {
+	key := pbkdf2SHA1([]byte(password), salt, 1000, keySize*2+2)
+	return key[:keySize], key[keySize : keySize*2], key[keySize*2:]
+}
+
+// CTR mode of WinZip AES, the counter is little endian and starts from 1, unlike cipher.NewCTR
+type winzipCTR struct {
+	block   cipher.Block
+	counter [aes.BlockSize]byte
+	stream  [aes.BlockSize]byte
+	pos     int
+}
+
+func newWinzipCTR(key []byte) (*winzipCTR, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &winzipCTR{block: block, pos: aes.BlockSize}, nil
+}
+
+func (c *winzipCTR) XORKeyStream(dst, src []byte) {
+	for len(src) > 0 {
+		if c.pos == aes.BlockSize {
+			for i := range c.counter {
+				c.counter[i]++
+				if c.counter[i] != 0 {
+					break
+				}
+			}
+			c.block.Encrypt(c.stream[:], c.counter[:])
+			c.pos = 0
+		}
+		n := subtle.XORBytes(dst, src, c.stream[c.pos:])
+		c.pos += n
+		dst, src = dst[n:], src[n:]
+	}
+}
+
+// extra field of AE-2 with AES-256, method is the actual compression method
+func aesExtra(method uint16) []byte {
+	extra := make([]byte, 11)
+	binary.LittleEndian.PutUint16(extra[0:], zipExtraAES)
+	binary.LittleEndian.PutUint16(extra[2:], 7)
+	// vendor version AE-2, vendor ID "AE", strength 3 for 256 bits
+	binary.LittleEndian.PutUint16(extra[4:], 2)
+	copy(extra[6:], "AE")
+	extra[8] = 3
+	binary.LittleEndian.PutUint16(extra[9:], method)
+	return extra
+}
+
+// aesWriter encrypts content of an entry by WinZip AES-256, salt and password verifier are written first,
+// authentication code is written by Close
+type aesWriter struct {
+	w   io.Writer
+	ctr *winzipCTR
+	mac hash.Hash
+	buf []byte
+}
+
+func newAESWriter(w io.Writer, password string) (*aesWriter, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aesKey, macKey, verifier := aesKeys(password, salt, 32)
+	ctr, err := newWinzipCTR(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append(salt, verifier...)); err != nil {
+		return nil, err
+	}
+	return &aesWriter{w: w, ctr: ctr, mac: hmac.New(sha1.New, macKey)}, nil
+}
+
+func (a *aesWriter) Write(p []byte) (int, error) {
+	if cap(a.buf) < len(p) {
+		a.buf = make([]byte, len(p))
+	}
+	buf := a.buf[:len(p)]
+	a.ctr.XORKeyStream(buf, p)
+	a.mac.Write(buf)
+	return a.w.Write(buf)
+}
+
+func (a *aesWriter) Close() error {
+	_, err := a.w.Write(a.mac.Sum(nil)[:aesMACSize])
+	return err
+}
+
+// strength, vendor version and actual method in the extra field of AES
+func parseAESExtra(extra []byte) (keySize int, version uint16, method uint16, err error) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			break
+		}
+		if id == zipExtraAES && size >= 7 {
+			field := extra[4 : 4+size]
+			version, method = binary.LittleEndian.Uint16(field), binary.LittleEndian.Uint16(field[5:])
+			switch field[4] {
+			case 1:
+				keySize = 16
+			case 2:
+				keySize = 24
+			case 3:
+				keySize = 32
+			default:
+				return 0, 0, 0, fmt.Errorf("invalid AES strength %d", field[4])
+			}
+			return keySize, version, method, nil
+		}
+		extra = extra[4+size:]
+	}
+	return 0, 0, 0, errors.New("extra field of AES is missing")
+}
+
+// keys of ZipCrypto
+type zipCryptoKeys [3]uint32
+
+func newZipCryptoKeys(password string) *zipCryptoKeys {
+	k := &zipCryptoKeys{0x12345678, 0x23456789, 0x34567890}
+	for i := 0; i < len(password); i++ {
+		k.update(password[i])
+	}
+	return k
+}
+
+func (k *zipCryptoKeys) update(b byte) {
+	k[0] = crc32.IEEETable[byte(k[0])^b] ^ (k[0] >> 8)
+	k[1] = (k[1]+(k[0]&0xff))*134775813 + 1
+	k[2] = crc32.IEEETable[byte(k[2])^byte(k[1]>>24)] ^ (k[2] >> 8)
+}
+
+func (k *zipCryptoKeys) decrypt(p []byte) {
+	for i := range p {
+		t := k[2] | 2
+		p[i] ^= byte((t * (t ^ 1)) >> 8)
+		k.update(p[i])
+	}
+}
+
+type zipCryptoReader struct {
+	r    io.Reader
+	keys *zipCryptoKeys
+}
+
+func (z *zipCryptoReader) Read(p []byte) (int, error) {
+	n, err := z.r.Read(p)
+	z.keys.decrypt(p[:n])
+	return n, err
+}
+
+// reader calling check at EOF, its error replaces EOF
+type checkedReader struct {
+	r       io.Reader
+	check   func() error
+	checked bool
+}
+
+func (c *checkedReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if err == io.EOF && !c.checked {
+		c.checked = true
+		if checkErr := c.check(); checkErr != nil {
+			return n, checkErr
+		}
+	}
+	return n, err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// decompressor of methods supported by zip.Reader
+func zipDecompress(method uint16, r io.Reader) (io.ReadCloser, error) {
+	switch method {
+	case zip.Store:
+		return io.NopCloser(r), nil
+	case zip.Deflate:
+		return flate.NewReader(r), nil
+	case zstd.ZipMethodWinZip, zstd.ZipMethodPKWare:
+		return zstd.ZipDecompressor()(r), nil
+	}
+	return nil, zip.ErrAlgorithm
+}
+
+// openZipEntry opens content of zip entry, encrypted entries are decrypted by password which is called only for them
+func openZipEntry(f *zip.File, password func() (string, error)) (io.ReadCloser, error) {
+	if f.Flags&zipFlagEncrypted == 0 {
+		return f.Open()
+	}
+	if f.Flags&zipFlagStrongEncryption != 0 {
+		return nil, errors.New("strong encryption is not supported")
+	}
+	pass, err := password()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := f.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+	var plain io.Reader
+	method := f.Method
+	// CRC32 is checked unless it is AE-2, whose CRC32 is 0 and the authentication code is checked instead
+	checkCRC := true
+	if f.Method == zipMethodAES {
+		var keySize int
+		var version uint16
+		keySize, version, method, err = parseAESExtra(f.Extra)
+		if err != nil {
+			return nil, err
+		}
+		checkCRC = version == 1
+		if plain, err = openAES(raw, int64(f.CompressedSize64), pass, keySize); err != nil {
+			return nil, err
+		}
+	} else {
+		// the last byte of the encryption header is checked by high byte of CRC32, or of time if CRC32 is in data descriptor
+		check := byte(f.CRC32 >> 24)
+		if f.Flags&zipFlagDataDescriptor != 0 {
+			check = byte(f.ModifiedTime >> 8)
+		}
+		if plain, err = openZipCrypto(raw, int64(f.CompressedSize64), pass, check); err != nil {
+			return nil, err
+		}
+	}
+	rc, err := zipDecompress(method, plain)
+	if err != nil {
+		return nil, err
+	}
+	if !checkCRC {
+		// the authentication code is checked at the end of compressed data
+		return readCloser{Reader: &checkedReader{r: rc, check: func() error {
+			_, err := io.Copy(io.Discard, plain)
+			return err
+		}}, Closer: rc}, nil
+	}
+	crc := crc32.NewIEEE()
+	var size uint64
+	return readCloser{Reader: &checkedReader{r: io.TeeReader(rc, writerFunc(func(p []byte) (int, error) {
+		size += uint64(len(p))
+		return crc.Write(p)
+	})), check: func() error {
+		if size != f.UncompressedSize64 || crc.Sum32() != f.CRC32 {
+			return fmt.Errorf("%w or corrupt data, checksum mismatch", errWrongPassword)
+		}
+		return nil
+	}}, Closer: rc}, nil
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+// decrypted content of AES, the authentication code is checked at the end
+func openAES(raw io.Reader, size int64, password string, keySize int) (io.Reader, error) {
+	saltSize := keySize / 2
+	if size < int64(saltSize+2+aesMACSize) {
+		return nil, errors.New("encrypted data is too short")
+	}
+	head := make([]byte, saltSize+2)
+	if _, err := io.ReadFull(raw, head); err != nil {
+		return nil, err
+	}
+	aesKey, macKey, verifier := aesKeys(password, head[:saltSize], keySize)
+	if !bytes.Equal(verifier, head[saltSize:]) {
+		return nil, errWrongPassword
+	}
+	ctr, err := newWinzipCTR(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha1.New, macKey)
+	data := io.TeeReader(io.LimitReader(raw, size-int64(len(head))-aesMACSize), mac)
+	return &checkedReader{r: cipher.StreamReader{S: ctr, R: data}, check: func() error {
+		code := make([]byte, aesMACSize)
+		if _, err := io.ReadFull(raw, code); err != nil {
+			return err
+		}
+		if !hmac.Equal(code, mac.Sum(nil)[:aesMACSize]) {
+			return fmt.Errorf("%w or corrupt data, authentication failed", errWrongPassword)
+		}
+		return nil
+	}}, nil
+}
+
+// decrypted content of ZipCrypto, check is the expected last byte of the encryption header
+func openZipCrypto(raw io.Reader, size int64, password string, check byte) (io.Reader, error) {
+	if size < 12 {
+		return nil, errors.New("encrypted data is too short")
+	}
+	keys := newZipCryptoKeys(password)
+	head := make([]byte, 12)
+	if _, err := io.ReadFull(raw, head); err != nil {
+		return nil, err
+	}
+	keys.decrypt(head)
+	if head[11] != check {
+		return nil, errWrongPassword
+	}
+	return &zipCryptoReader{r: io.LimitReader(raw, size-12), keys: keys}, nil
+}
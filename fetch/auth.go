@@ -0,0 +1,288 @@
+package fetch
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Credentials of HTTP authentication
+type Credentials struct {
+	// Basic or Digest by challenge of the server
+	User     string
+	Password string
+	// sent as "Authorization: Bearer <token>" without challenge
+	Bearer string
+}
+
+// adds credentials to requests of the origins they belong to, so they are not sent to other hosts, schemes or
+// ports after redirects, and never after a redirect from https to http.
+//
+// User and password are sent after the server challenges, the scheme of the challenge is remembered for
+// the origin, so later requests are authenticated directly, the password isn't sent in Basic to a Digest server.
+type authTransport struct {
+	base http.RoundTripper
+	// key is origin
+	credentials map[string]*Credentials
+	l           sync.Mutex
+	// challenge accepted last time by origin
+	challenges map[string]*authChallenge
+}
+
+type authChallenge struct {
+	scheme string
+	params map[string]string
+	// nonce count of Digest
+	nc int64
+}
+
+// Origin of u like "https://example.com:443", the default port of the scheme is filled
+func Origin(u *url.URL) string {
+	scheme := strings.ToLower(u.Scheme)
+	port := u.Port()
+	if port == "" {
+		switch scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		}
+	}
+	return scheme + "://" + strings.ToLower(u.Hostname()) + ":" + port
+}
+
+// keys of credentials are origins or URLs, keys which aren't URLs are ignored
+func newAuthTransport(base http.RoundTripper, credentials map[string]*Credentials) *authTransport {
+	m := make(map[string]*Credentials, len(credentials))
+	for key, c := range credentials {
+		if u, err := url.Parse(key); err == nil && u.Scheme != "" && u.Host != "" {
+			m[Origin(u)] = c
+		}
+	}
+	return &authTransport{base: base, credentials: m, challenges: make(map[string]*authChallenge)}
+}
+
+// whether req is redirected from https to http, even if by several redirects
+func isDowngrade(req *http.Request) bool {
+	if req.URL.Scheme != "http" {
+		return false
+	}
+	for resp := req.Response; resp != nil && resp.Request != nil; resp = resp.Request.Response {
+		if resp.Request.URL.Scheme == "https" {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	origin := Origin(req.URL)
+	c := t.credentials[origin]
+	// Authorization given by header flag wins
+	if c == nil || req.Header.Get("Authorization") != "" || isDowngrade(req) {
+		return t.base.RoundTrip(req)
+	}
+	if c.Bearer != "" {
+		req = cloneRequest(req)
+		req.Header.Set("Authorization", "Bearer "+c.Bearer)
+		return t.base.RoundTrip(req)
+	}
+	t.l.Lock()
+	challenge := t.challenges[origin]
+	t.l.Unlock()
+	first := req
+	if challenge != nil {
+		first = cloneRequest(req)
+		first.Header.Set("Authorization", challenge.authorization(c, req))
+	}
+	resp, err := t.base.RoundTrip(first)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	next := pickChallenge(resp.Header.Values("WWW-Authenticate"))
+	if next == nil {
+		return resp, nil
+	}
+	// the same credentials were rejected, unless the nonce is stale
+	if challenge != nil && challenge.scheme == next.scheme && !strings.EqualFold(next.params["stale"], "true") {
+		return resp, nil
+	}
+	// the body of the first request has been consumed
+	retry := cloneRequest(req)
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return resp, nil
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		retry.Body = body
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	t.l.Lock()
+	t.challenges[origin] = next
+	t.l.Unlock()
+	retry.Header.Set("Authorization", next.authorization(c, req))
+	return t.base.RoundTrip(retry)
+}
+
+// shallow copy with a copy of header, a RoundTripper must not modify the request
+func cloneRequest(req *http.Request) *http.Request {
+	r := new(http.Request)
+	*r = *req
+	r.Header = req.Header.Clone()
+	return r
+}
+
+// Digest is preferred to Basic, nil if neither is offered or the Digest algorithm is unsupported
+func pickChallenge(values []string) *authChallenge {
+	var basic *authChallenge
+	for _, value := range values {
+		for _, c := range parseChallenges(value) {
+			switch c.scheme {
+			case "digest":
+				if digestHash(c.params["algorithm"]) != nil && c.params["nonce"] != "" && digestQop(c.params["qop"]) != "-" {
+					return c
+				}
+			case "basic":
+				basic = c
+			}
+		}
+	}
+	return basic
+}
+
+// parse WWW-Authenticate, a value may contain several challenges like `Basic realm="a", Digest realm="b", nonce="c"`
+func parseChallenges(value string) []*authChallenge {
+	var challenges []*authChallenge
+	var current *authChallenge
+	s := value
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return challenges
+		}
+		i := strings.IndexAny(s, " \t,=")
+		if i < 0 {
+			i = len(s)
+		}
+		token := s[:i]
+		s = strings.TrimLeft(s[i:], " \t")
+		if !strings.HasPrefix(s, "=") {
+			// a token not followed by "=" starts a new challenge
+			current = &authChallenge{scheme: strings.ToLower(token), params: make(map[string]string)}
+			challenges = append(challenges, current)
+			continue
+		}
+		s = strings.TrimLeft(s[1:], " \t")
+		var v string
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			j := 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+				}
+				b.WriteByte(s[j])
+			}
+			v, s = b.String(), s[min(j+1, len(s)):]
+		} else {
+			j := strings.IndexAny(s, " \t,")
+			if j < 0 {
+				j = len(s)
+			}
+			v, s = s[:j], s[j:]
+		}
+		// token68 of a challenge like `Negotiate abc=` is ignored
+		if current != nil {
+			current.params[strings.ToLower(token)] = v
+		}
+	}
+}
+
+// nil if algorithm is unsupported, "-sess" variants use the same hash
+func digestHash(algorithm string) func() hash.Hash {
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "", "MD5":
+		return md5.New
+	case "SHA-256":
+		return sha256.New
+	}
+	return nil
+}
+
+// "auth" if offered, "" if qop is absent, "-" if only unsupported qop like "auth-int" is offered
+func digestQop(qop string) string {
+	if qop == "" {
+		return ""
+	}
+	for _, q := range strings.Split(qop, ",") {
+		if strings.TrimSpace(q) == "auth" {
+			return "auth"
+		}
+	}
+	return "-"
+}
+
+func (c *authChallenge) authorization(credentials *Credentials, req *http.Request) string {
+	if c.scheme == "basic" {
+		r := &http.Request{Header: make(http.Header)}
+		r.SetBasicAuth(credentials.User, credentials.Password)
+		return r.Header.Get("Authorization")
+	}
+	p := c.params
+	newHash := digestHash(p["algorithm"])
+	h := func(s string) string {
+		hh := newHash()
+		hh.Write([]byte(s))
+		return hex.EncodeToString(hh.Sum(nil))
+	}
+	cnonceBytes := make([]byte, 8)
+	rand.Read(cnonceBytes)
+	cnonce := hex.EncodeToString(cnonceBytes)
+	nc := fmt.Sprintf("%08x", atomic.AddInt64(&c.nc, 1))
+	uri := req.URL.RequestURI()
+	ha1 := h(credentials.User + ":" + p["realm"] + ":" + credentials.Password)
+	if strings.HasSuffix(strings.ToUpper(p["algorithm"]), "-SESS") {
+		ha1 = h(ha1 + ":" + p["nonce"] + ":" + cnonce)
+	}
+	ha2 := h(req.Method + ":" + uri)
+	qop := digestQop(p["qop"])
+	var response string
+	if qop == "" {
+		response = h(ha1 + ":" + p["nonce"] + ":" + ha2)
+	} else {
+		response = h(ha1 + ":" + p["nonce"] + ":" + nc + ":" + cnonce + ":" + qop + ":" + ha2)
+	}
+	quote := func(s string) string {
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+	}
+	parts := []string{
+		"username=" + quote(credentials.User),
+		"realm=" + quote(p["realm"]),
+		"nonce=" + quote(p["nonce"]),
+		"uri=" + quote(uri),
+		"response=" + quote(response),
+	}
+	if p["algorithm"] != "" {
+		parts = append(parts, "algorithm="+p["algorithm"])
+	}
+	if p["opaque"] != "" {
+		parts = append(parts, "opaque="+quote(p["opaque"]))
+	}
+	if qop != "" {
+		parts = append(parts, "qop="+qop, "nc="+nc, "cnonce="+quote(cnonce))
+	}
+	return "Digest " + strings.Join(parts, ", ")
+}
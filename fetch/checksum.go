@@ -0,0 +1,251 @@
+package fetch
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Expected digest of a file
+type Checksum struct {
+	// md5 sha1 sha256 sha512
+	Algorithm string
+	// lower case
+	Hex string
+}
+
+var checksumHexLength = map[string]int{
+	"md5":    32,
+	"sha1":   40,
+	"sha256": 64,
+	"sha512": 128,
+}
+
+func newHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "md5":
+		return md5.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported checksum algorithm: %s", algorithm)
+}
+
+// guess algorithm by length of hex
+func algorithmByHexLength(n int) string {
+	for k, v := range checksumHexLength {
+		if v == n {
+			return k
+		}
+	}
+	return ""
+}
+
+// create checksum, if algorithm is empty, guess it by length of hex
+func NewChecksum(algorithm string, hexValue string) (*Checksum, error) {
+	algorithm = strings.ReplaceAll(strings.ToLower(strings.TrimSpace(algorithm)), "-", "")
+	hexValue = strings.ToLower(strings.TrimSpace(hexValue))
+	if algorithm == "" {
+		algorithm = algorithmByHexLength(len(hexValue))
+		if algorithm == "" {
+			return nil, fmt.Errorf("unable to guess checksum algorithm of %s", hexValue)
+		}
+	}
+	n, ok := checksumHexLength[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported checksum algorithm: %s", algorithm)
+	}
+	if _, err := hex.DecodeString(hexValue); err != nil || len(hexValue) != n {
+		return nil, fmt.Errorf("invalid %s checksum: %s", algorithm, hexValue)
+	}
+	return &Checksum{Algorithm: algorithm, Hex: hexValue}, nil
+}
+
+// parse checksum like "sha256:<hex>", the algorithm can be omitted
+func ParseChecksum(s string) (*Checksum, error) {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexAny(s, ":="); i > -1 {
+		return NewChecksum(s[:i], s[i+1:])
+	}
+	return NewChecksum("", s)
+}
+
+var bsdChecksumLineRegex = regexp.MustCompile(`^(?i)(MD5|SHA1|SHA256|SHA512|SHA-256|SHA-512|SHA-1) ?\((.+)\) ?= ?([0-9a-fA-F]+)$`)
+
+// find checksum of name in content of checksum file such as SHA256SUMS,
+// both GNU style "<hex>  <name>" and BSD style "SHA256 (<name>) = <hex>" are supported
+func LookupChecksum(r io.Reader, name string) (*Checksum, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if m := bsdChecksumLineRegex.FindStringSubmatch(line); m != nil {
+			if matchChecksumName(m[2], name) {
+				return NewChecksum(m[1], m[3])
+			}
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		// "*" means binary mode
+		entry := strings.TrimPrefix(strings.TrimSpace(fields[1]), "*")
+		if matchChecksumName(entry, name) {
+			return NewChecksum("", fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("checksum of %s not found", name)
+}
+
+func matchChecksumName(entry, name string) bool {
+	entry = strings.TrimPrefix(strings.ReplaceAll(entry, `\`, `/`), "./")
+	return entry == name || path.Base(entry) == name
+}
+
+func (c *Checksum) String() string {
+	return c.Algorithm + ":" + c.Hex
+}
+
+func (c *Checksum) NewHash() hash.Hash {
+	h, _ := newHash(c.Algorithm)
+	return h
+}
+
+// compare with sum
+func (c *Checksum) Verify(sum []byte) error {
+	if v := hex.EncodeToString(sum); v != c.Hex {
+		return fmt.Errorf("%s checksum mismatch, expected %s, got %s", c.Algorithm, c.Hex, v)
+	}
+	return nil
+}
+
+func (c *Checksum) VerifyFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := c.NewHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	return c.Verify(h.Sum(nil))
+}
+
+// PrefixHasher hashes a file while it is being written, it follows the contiguous written part from offset 0,
+// so ranges downloaded in order are hashed before the whole download finished
+type PrefixHasher struct {
+	name   string
+	h      hash.Hash
+	prefix func() int64
+	hashed int64
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+	once   sync.Once
+}
+
+// prefix returns length of contiguous written part from offset 0, such as FileWriter.Prefix
+func NewPrefixHasher(name string, h hash.Hash, prefix func() int64) *PrefixHasher {
+	return &PrefixHasher{
+		name:   name,
+		h:      h,
+		prefix: prefix,
+		done:   make(chan struct{}),
+	}
+}
+
+// hash [hashed, end)
+func (ph *PrefixHasher) hashTo(f *os.File, end int64) error {
+	if end <= ph.hashed {
+		return nil
+	}
+	n, err := io.Copy(ph.h, io.NewSectionReader(f, ph.hashed, end-ph.hashed))
+	ph.hashed += n
+	if err == nil && ph.hashed != end {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Start hashing in background until Sum is called
+func (ph *PrefixHasher) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	ph.cancel = cancel
+	go func() {
+		defer close(ph.done)
+		f, err := os.Open(ph.name)
+		if err != nil {
+			ph.err = err
+			return
+		}
+		defer f.Close()
+		ticker := time.NewTicker(time.Millisecond * 200)
+		defer ticker.Stop()
+		for {
+			if err := ph.hashTo(f, ph.prefix()); err != nil {
+				ph.err = err
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Sum stops background hashing, hashes the rest until size and returns the sum
+func (ph *PrefixHasher) Sum(size int64) ([]byte, error) {
+	if ph.cancel == nil {
+		return nil, errors.New("hasher not started")
+	}
+	ph.once.Do(func() {
+		ph.cancel()
+		<-ph.done
+		if ph.err != nil {
+			return
+		}
+		var f *os.File
+		f, ph.err = os.Open(ph.name)
+		if ph.err != nil {
+			return
+		}
+		defer f.Close()
+		ph.err = ph.hashTo(f, size)
+	})
+	if ph.err != nil {
+		return nil, ph.err
+	}
+	return ph.h.Sum(nil), nil
+}
+
+// Hashed returns length of hashed part, it is valid after Sum returned
+func (ph *PrefixHasher) Hashed() int64 {
+	return ph.hashed
+}
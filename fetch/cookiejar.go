@@ -0,0 +1,275 @@
+package fetch
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// Cookie jar which can be loaded from and saved to a Netscape cookie file, the format used by curl and wget
+type CookieJar struct {
+	l sync.Mutex
+	// key is domain, path and name
+	entries map[string]*jarEntry
+}
+
+type jarEntry struct {
+	Domain string
+	// the cookie is sent to the domain only, not its subdomains
+	HostOnly bool
+	Path     string
+	Secure   bool
+	HttpOnly bool
+	// zero for session cookies
+	Expires time.Time
+	Name    string
+	Value   string
+}
+
+func (e *jarEntry) key() string {
+	return e.Domain + ";" + e.Path + ";" + e.Name
+}
+
+func (e *jarEntry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !e.Expires.After(now)
+}
+
+func NewCookieJar() *CookieJar {
+	return &CookieJar{entries: make(map[string]*jarEntry)}
+}
+
+// default path of cookie by RFC 6265 section 5.1.4
+func defaultCookiePath(p string) string {
+	i := strings.LastIndex(p, "/")
+	if !strings.HasPrefix(p, "/") || i <= 0 {
+		return "/"
+	}
+	return p[:i]
+}
+
+func cookiePathMatch(cookiePath, p string) bool {
+	if p == "" {
+		p = "/"
+	}
+	if !strings.HasPrefix(p, cookiePath) {
+		return false
+	}
+	return len(p) == len(cookiePath) || strings.HasSuffix(cookiePath, "/") || p[len(cookiePath)] == '/'
+}
+
+func (e *jarEntry) domainMatch(host string) bool {
+	return host == e.Domain || (!e.HostOnly && strings.HasSuffix(host, "."+e.Domain))
+}
+
+// whether domain is a public suffix like com or co.uk, which is shared by unrelated hosts
+func isPublicSuffix(domain string) bool {
+	suffix, _ := publicsuffix.PublicSuffix(domain)
+	return suffix == domain
+}
+
+// SetCookies implements http.CookieJar, cookies with a domain not matching u are rejected
+func (j *CookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	host := strings.ToLower(u.Hostname())
+	now := time.Now()
+	j.l.Lock()
+	defer j.l.Unlock()
+	for _, c := range cookies {
+		e := &jarEntry{
+			Domain:   host,
+			HostOnly: true,
+			Path:     c.Path,
+			Secure:   c.Secure,
+			HttpOnly: c.HttpOnly,
+			Name:     c.Name,
+			Value:    c.Value,
+		}
+		if domain := strings.TrimPrefix(strings.ToLower(c.Domain), "."); domain != "" && domain != host {
+			// an IP address can't set cookies for other hosts, neither can a host set them for a public suffix like com
+			if net.ParseIP(host) != nil || !strings.HasSuffix(host, "."+domain) || isPublicSuffix(domain) {
+				continue
+			}
+			e.Domain, e.HostOnly = domain, false
+		} else if domain != "" && !isPublicSuffix(domain) {
+			e.HostOnly = false
+		}
+		if !strings.HasPrefix(e.Path, "/") {
+			e.Path = defaultCookiePath(u.Path)
+		}
+		switch {
+		case c.MaxAge < 0:
+			e.Expires = now
+		case c.MaxAge > 0:
+			e.Expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+		case !c.Expires.IsZero():
+			e.Expires = c.Expires
+		}
+		if e.expired(now) {
+			delete(j.entries, e.key())
+			continue
+		}
+		j.entries[e.key()] = e
+	}
+}
+
+// Cookies implements http.CookieJar, cookies with longer paths are listed first
+func (j *CookieJar) Cookies(u *url.URL) []*http.Cookie {
+	host := strings.ToLower(u.Hostname())
+	secure := u.Scheme == "https"
+	now := time.Now()
+	j.l.Lock()
+	var selected []*jarEntry
+	for key, e := range j.entries {
+		if e.expired(now) {
+			delete(j.entries, key)
+			continue
+		}
+		if (e.Secure && !secure) || !e.domainMatch(host) || !cookiePathMatch(e.Path, u.Path) {
+			continue
+		}
+		selected = append(selected, e)
+	}
+	j.l.Unlock()
+	sort.Slice(selected, func(a, b int) bool {
+		if len(selected[a].Path) != len(selected[b].Path) {
+			return len(selected[a].Path) > len(selected[b].Path)
+		}
+		return selected[a].Name < selected[b].Name
+	})
+	cookies := make([]*http.Cookie, len(selected))
+	for i, e := range selected {
+		cookies[i] = &http.Cookie{Name: e.Name, Value: e.Value}
+	}
+	return cookies
+}
+
+// Load adds cookies of a Netscape cookie file, expired cookies are skipped
+func (j *CookieJar) Load(r io.Reader) error {
+	const httpOnlyPrefix = "#HttpOnly_"
+	now := time.Now()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	j.l.Lock()
+	defer j.l.Unlock()
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		httpOnly := strings.HasPrefix(line, httpOnlyPrefix)
+		if httpOnly {
+			line = line[len(httpOnlyPrefix):]
+		}
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		// value may be empty
+		if len(fields) == 6 {
+			fields = append(fields, "")
+		}
+		if len(fields) != 7 {
+			return fmt.Errorf("invalid cookie at line %d", n)
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid expires of cookie at line %d", n)
+		}
+		e := &jarEntry{
+			Domain:   strings.TrimPrefix(strings.ToLower(fields[0]), "."),
+			HostOnly: !strings.EqualFold(fields[1], "TRUE"),
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			HttpOnly: httpOnly,
+			Name:     fields[5],
+			Value:    fields[6],
+		}
+		if expires > 0 {
+			e.Expires = time.Unix(expires, 0)
+		}
+		if e.expired(now) {
+			continue
+		}
+		j.entries[e.key()] = e
+	}
+	return scanner.Err()
+}
+
+// Save writes unexpired cookies in Netscape format, session cookies are saved with expires 0 like curl
+func (j *CookieJar) Save(w io.Writer) error {
+	now := time.Now()
+	j.l.Lock()
+	var entries []*jarEntry
+	for _, e := range j.entries {
+		if !e.expired(now) {
+			entries = append(entries, e)
+		}
+	}
+	j.l.Unlock()
+	sort.Slice(entries, func(a, b int) bool {
+		return entries[a].key() < entries[b].key()
+	})
+	bw := bufio.NewWriter(w)
+	bw.WriteString("# Netscape HTTP Cookie File\n\n")
+	boolString := func(b bool) string {
+		if b {
+			return "TRUE"
+		}
+		return "FALSE"
+	}
+	for _, e := range entries {
+		domain := e.Domain
+		if !e.HostOnly {
+			domain = "." + domain
+		}
+		if e.HttpOnly {
+			domain = "#HttpOnly_" + domain
+		}
+		var expires int64
+		if !e.Expires.IsZero() {
+			expires = e.Expires.Unix()
+		}
+		fmt.Fprintf(bw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", domain, boolString(!e.HostOnly), e.Path, boolString(e.Secure), expires, e.Name, e.Value)
+	}
+	return bw.Flush()
+}
+
+// LoadFile loads a Netscape cookie file, it is fine if the file doesn't exist
+func (j *CookieJar) LoadFile(name string) error {
+	f, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return j.Load(f)
+}
+
+// SaveFile saves cookies to a Netscape cookie file, it is written to a temporary file first and then renamed
+func (j *CookieJar) SaveFile(name string) error {
+	temp := name + ".temp"
+	f, err := os.OpenFile(temp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := j.Save(f); err != nil {
+		f.Close()
+		os.Remove(temp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return os.Rename(temp, name)
+}
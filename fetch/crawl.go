@@ -0,0 +1,502 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CrawlDownloaded = "downloaded"
+	// not modified since the local file, it is not downloaded again
+	CrawlUnchanged = "unchanged"
+	CrawlFailed    = "failed"
+)
+
+// pages and style sheets larger than it are not parsed, they are downloaded like other files
+const maxPageSize = 64 * 1024 * 1024
+
+type CrawlOption struct {
+	Context context.Context
+	// local directory, files are saved as <dir>/<host>/<path>
+	Dir string
+	// maximum depth of links to follow from the root, 0 means unlimited,
+	// page requisites like images and style sheets of a page are downloaded even beyond the depth
+	Depth int
+	// allow URLs out of the directory of root URL, URLs must be on the same host anyway
+	AllowParent bool
+	// URLs matched by Reject are never requested, files whose URLs are not matched by Accept are not saved,
+	// but HTML pages are still requested for links
+	Accept *regexp.Regexp
+	Reject *regexp.Regexp
+	// do not read robots.txt
+	IgnoreRobots bool
+	// rewrite links in pages and style sheets after all downloaded, links to downloaded files become relative,
+	// others become absolute
+	ConvertLinks bool
+	// number of files downloaded at the same time, default 4
+	Jobs int
+	// files larger than it are downloaded by ranges with Download option, default 4MB
+	RangeThreshold int64
+	Download       DownloadOption
+	// called when a URL is done, status is one of CrawlDownloaded CrawlUnchanged CrawlFailed, optional
+	OnFile func(u string, output string, status string, size int64, err error)
+	// called after bytes are written, optional
+	OnWrite func(n int)
+}
+
+type CrawlStats struct {
+	Downloaded int
+	Unchanged  int
+	Failed     int
+}
+
+type crawler struct {
+	fetcher *Fetcher
+	option  *CrawlOption
+	ctx     context.Context
+	root    *url.URL
+	// URLs must start with it unless AllowParent is true
+	scope string
+	sem   chan struct{}
+	wg    sync.WaitGroup
+
+	l     sync.Mutex
+	seen  map[string]bool
+	stats CrawlStats
+	// url => local file, for converting links
+	files map[string]string
+	// local file => URL, pages and style sheets whose links should be converted
+	pages map[string]*url.URL
+
+	robotsL sync.Mutex
+	robots  map[string]*robotsRules
+}
+
+// Crawl downloads the root URL and follows links in HTML pages and style sheets recursively like "wget -r".
+//
+// Only URLs of the same host under the directory of root are followed, robots.txt is honoured.
+// If a local file exists, the request is sent with If-Modified-Since, and the file is kept if not modified,
+// modification time of downloaded file is set by Last-Modified.
+func (fetcher *Fetcher) Crawl(root string, option *CrawlOption) (*CrawlStats, error) {
+	if option == nil {
+		option = &CrawlOption{}
+	}
+	if option.Jobs <= 0 {
+		option.Jobs = 4
+	}
+	if option.RangeThreshold <= 0 {
+		option.RangeThreshold = 4 * 1024 * 1024
+	}
+	if option.Context == nil {
+		option.Context = context.Background()
+	}
+	u, err := url.Parse(root)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme of %s", root)
+	}
+	c := &crawler{
+		fetcher: fetcher,
+		option:  option,
+		ctx:     option.Context,
+		root:    u,
+		sem:     make(chan struct{}, option.Jobs),
+		seen:    make(map[string]bool),
+		files:   make(map[string]string),
+		pages:   make(map[string]*url.URL),
+		robots:  make(map[string]*robotsRules),
+	}
+	dir := u.EscapedPath()
+	if i := strings.LastIndex(dir, "/"); i > -1 {
+		dir = dir[:i+1]
+	} else {
+		dir = "/"
+	}
+	c.scope = u.Scheme + "://" + u.Host + dir
+	if option.AllowParent {
+		c.scope = u.Scheme + "://" + u.Host + "/"
+	}
+	c.enqueue(u, 0, false)
+	c.wg.Wait()
+	if option.ConvertLinks {
+		c.convertLinks()
+	}
+	return &c.stats, option.Context.Err()
+}
+
+func (c *crawler) inScope(u *url.URL) bool {
+	s := u.Scheme + "://" + u.Host + u.EscapedPath()
+	return strings.HasPrefix(s, c.scope) || s+"/" == c.scope
+}
+
+func (c *crawler) enqueue(u *url.URL, depth int, requisite bool) {
+	if !c.inScope(u) {
+		return
+	}
+	if c.option.Reject != nil && c.option.Reject.MatchString(u.String()) {
+		return
+	}
+	if depth > 0 && !requisite && c.option.Depth > 0 && depth > c.option.Depth {
+		return
+	}
+	key := u.String()
+	c.l.Lock()
+	if c.seen[key] {
+		c.l.Unlock()
+		return
+	}
+	c.seen[key] = true
+	c.l.Unlock()
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		select {
+		case c.sem <- struct{}{}:
+		case <-c.ctx.Done():
+			return
+		}
+		defer func() { <-c.sem }()
+		output, size, status, err := c.visit(u, depth)
+		if status == "" {
+			return
+		}
+		c.l.Lock()
+		switch status {
+		case CrawlDownloaded:
+			c.stats.Downloaded++
+		case CrawlUnchanged:
+			c.stats.Unchanged++
+		case CrawlFailed:
+			c.stats.Failed++
+		}
+		c.l.Unlock()
+		if c.option.OnFile != nil {
+			c.option.OnFile(key, output, status, size, err)
+		}
+	}()
+}
+
+// rules of robots.txt of host, fetched once
+func (c *crawler) robotsOf(u *url.URL) *robotsRules {
+	c.robotsL.Lock()
+	defer c.robotsL.Unlock()
+	origin := u.Scheme + "://" + u.Host
+	if rules, ok := c.robots[origin]; ok {
+		return rules
+	}
+	var rules *robotsRules
+	resp, err := c.fetcher.DoWithRetry(func() (*http.Request, error) {
+		return http.NewRequestWithContext(c.ctx, http.MethodGet, origin+"/robots.txt", nil)
+	})
+	// missing robots.txt allows everything
+	if err == nil {
+		if resp.StatusCode == http.StatusOK {
+			rules = parseRobots(io.LimitReader(resp.Body, 1024*1024), "spaceship")
+		}
+		resp.Body.Close()
+	}
+	c.robots[origin] = rules
+	return rules
+}
+
+// local file of URL: <dir>/<host>/<path>, "index.html" for directory, query is appended after "@"
+func (c *crawler) localPath(u *url.URL) string {
+	p := u.Path
+	if p == "" || strings.HasSuffix(p, "/") {
+		p += "index.html"
+	}
+	name := strings.TrimPrefix(path.Clean("/"+p), "/")
+	if u.RawQuery != "" {
+		name += "@" + strings.ReplaceAll(u.RawQuery, "/", "%2F")
+	}
+	host := u.Hostname()
+	if port := u.Port(); port != "" {
+		host += "_" + port
+	}
+	return filepath.Join(c.option.Dir, host, filepath.FromSlash(name))
+}
+
+func isHTMLType(contentType string) bool {
+	t, _, _ := mime.ParseMediaType(contentType)
+	return t == "text/html" || t == "application/xhtml+xml"
+}
+
+func isCSSType(contentType string) bool {
+	t, _, _ := mime.ParseMediaType(contentType)
+	return t == "text/css"
+}
+
+// pages without extension of HTML are saved with ".html", so they can be opened by browser
+func htmlPath(p string) string {
+	if ext := strings.ToLower(filepath.Ext(p)); ext != ".html" && ext != ".htm" {
+		return p + ".html"
+	}
+	return p
+}
+
+// visit downloads u and enqueues its links, empty status means u is skipped
+func (c *crawler) visit(u *url.URL, depth int) (output string, size int64, status string, err error) {
+	if !c.option.IgnoreRobots && !c.robotsOf(u).allowed(u.RequestURI()) {
+		return "", 0, "", nil
+	}
+	output = c.localPath(u)
+	// local file of last download, a page may be saved with ".html"
+	var local string
+	var localInfo os.FileInfo
+	for _, p := range []string{output, htmlPath(output)} {
+		if info, err := os.Stat(p); err == nil && !info.IsDir() {
+			local, localInfo = p, info
+			break
+		}
+	}
+	resp, err := c.fetcher.DoWithRetry(func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(c.ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		if localInfo != nil {
+			req.Header.Set("If-Modified-Since", localInfo.ModTime().UTC().Format(http.TimeFormat))
+		}
+		return req, nil
+	})
+	if err != nil {
+		return output, 0, CrawlFailed, err
+	}
+	defer resp.Body.Close()
+	// links in page are resolved against the URL after redirects
+	base := resp.Request.URL
+	if base.String() != u.String() && !c.inScope(base) {
+		return output, 0, CrawlFailed, fmt.Errorf("redirected to %s out of scope", base)
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if resp.StatusCode == http.StatusNotModified && localInfo != nil {
+		c.parseLocal(local, u, base, depth)
+		return local, localInfo.Size(), CrawlUnchanged, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return output, 0, CrawlFailed, fmt.Errorf("unexpected status \"%s\"", resp.Status)
+	}
+	accepted := c.option.Accept == nil || c.option.Accept.MatchString(u.String())
+	isHTML, isCSS := isHTMLType(contentType), isCSSType(contentType)
+	if !accepted && !isHTML {
+		return "", 0, "", nil
+	}
+	if isHTML {
+		output = htmlPath(output)
+	}
+	if isHTML || isCSS {
+		content, err := io.ReadAll(io.LimitReader(resp.Body, maxPageSize+1))
+		if err != nil {
+			return output, 0, CrawlFailed, err
+		}
+		if len(content) > maxPageSize {
+			if !accepted {
+				return "", 0, "", nil
+			}
+			// the whole page is downloaded with bytes already read
+			resp.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(content), resp.Body), resp.Body}
+			return c.downloaded(u, output, resp)
+		}
+		c.parseLinks(content, isHTML, base, depth)
+		if !accepted {
+			return "", 0, "", nil
+		}
+		if err := c.save(output, content, resp); err != nil {
+			return output, 0, CrawlFailed, err
+		}
+		c.l.Lock()
+		c.files[u.String()] = output
+		c.pages[output] = base
+		c.l.Unlock()
+		return output, int64(len(content)), CrawlDownloaded, nil
+	}
+	return c.downloaded(u, output, resp)
+}
+
+// download body of resp to output and record it
+func (c *crawler) downloaded(u *url.URL, output string, resp *http.Response) (string, int64, string, error) {
+	size, err := c.download(u, output, resp)
+	if err != nil {
+		return output, size, CrawlFailed, err
+	}
+	c.l.Lock()
+	c.files[u.String()] = output
+	c.l.Unlock()
+	return output, size, CrawlDownloaded, nil
+}
+
+// links of unchanged local page are still followed
+func (c *crawler) parseLocal(local string, u *url.URL, base *url.URL, depth int) {
+	c.l.Lock()
+	c.files[u.String()] = local
+	c.l.Unlock()
+	ext := strings.ToLower(filepath.Ext(local))
+	isHTML, isCSS := ext == ".html" || ext == ".htm", ext == ".css"
+	if !isHTML && !isCSS {
+		return
+	}
+	// links of converted page are local, the original is parsed instead
+	content, err := os.ReadFile(local + ".orig")
+	if err != nil {
+		if content, err = os.ReadFile(local); err != nil {
+			return
+		}
+	}
+	c.parseLinks(content, isHTML, base, depth)
+	c.l.Lock()
+	c.pages[local] = base
+	c.l.Unlock()
+}
+
+func (c *crawler) parseLinks(content []byte, isHTML bool, base *url.URL, depth int) {
+	var links []pageLink
+	if isHTML {
+		links = extractHTMLLinks(content, base)
+	} else {
+		links = extractCSSLinks(content, base)
+	}
+	for _, link := range links {
+		c.enqueue(link.URL, depth+1, link.Requisite)
+	}
+}
+
+func (c *crawler) mkdir(output string) error {
+	if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+		return fmt.Errorf("create directory of %s: %w", output, err)
+	}
+	return nil
+}
+
+// set modification time by Last-Modified, so If-Modified-Since of next crawl works
+func setModTime(output string, resp *http.Response) {
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		os.Chtimes(output, time.Now(), t)
+	}
+}
+
+func (c *crawler) save(output string, content []byte, resp *http.Response) error {
+	if err := c.mkdir(output); err != nil {
+		return err
+	}
+	if err := os.WriteFile(output, content, 0644); err != nil {
+		return err
+	}
+	// original of the old converted page
+	os.Remove(output + ".orig")
+	if c.option.OnWrite != nil {
+		c.option.OnWrite(len(content))
+	}
+	setModTime(output, resp)
+	return nil
+}
+
+// download body to a temp file and rename it, a large file supporting ranges is downloaded by ranges
+func (c *crawler) download(u *url.URL, output string, resp *http.Response) (int64, error) {
+	if err := c.mkdir(output); err != nil {
+		return 0, err
+	}
+	temp := output + ".temp"
+	fw, err := NewFileWriter(temp)
+	if err != nil {
+		return 0, err
+	}
+	defer fw.Close()
+	fw.OnWrite(func(n int, index int, start, end, length int64) {
+		if c.option.OnWrite != nil {
+			c.option.OnWrite(n)
+		}
+	})
+	length, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if length >= c.option.RangeThreshold && resp.Header.Get("Accept-Ranges") == "bytes" {
+		resp.Body.Close()
+		option := c.option.Download
+		option.Context = c.ctx
+		option.HookContext = fw.HookContext
+		option.IfRange = ValidatorsOf(newInspection(resp)).IfRange()
+		err = c.fetcher.DownloadWithManual(u.String(), true, length, &option)
+	} else {
+		err = fw.HookContext(c.ctx, 0, 0, 0, -1, c.fetcher.bodyOf(c.ctx, resp, nil, 0, -1))
+		if err == nil && resp.ContentLength >= 0 && fw.WrittenN() != resp.ContentLength {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	if err != nil {
+		return fw.WrittenN(), err
+	}
+	fw.Truncate(fw.WrittenN())
+	fw.Close()
+	if err := os.Rename(temp, output); err != nil {
+		return fw.WrittenN(), err
+	}
+	setModTime(output, resp)
+	return fw.WrittenN(), nil
+}
+
+// relative path from page to file, with URL escaping
+func relativeLink(page, file string) (string, error) {
+	rel, err := filepath.Rel(filepath.Dir(page), file)
+	if err != nil {
+		return "", err
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// the original page is kept as "<page>.orig", so that an unchanged page is parsed and converted again in next crawl
+func (c *crawler) convertLinks() {
+	for page, base := range c.pages {
+		info, err := os.Stat(page)
+		if err != nil {
+			continue
+		}
+		content, err := os.ReadFile(page + ".orig")
+		if err != nil {
+			if content, err = os.ReadFile(page); err != nil {
+				continue
+			}
+			if err := os.WriteFile(page+".orig", content, 0644); err != nil {
+				continue
+			}
+		}
+		mapping := func(u *url.URL) string {
+			if file, ok := c.files[u.String()]; ok {
+				if rel, err := relativeLink(page, file); err == nil {
+					return rel
+				}
+			}
+			return u.String()
+		}
+		ext := strings.ToLower(filepath.Ext(page))
+		if ext == ".html" || ext == ".htm" {
+			content = rewriteHTML(content, base, mapping)
+		} else {
+			content = rewriteCSS(content, base, mapping)
+		}
+		if err := os.WriteFile(page, content, 0644); err != nil {
+			continue
+		}
+		// keep modification time for If-Modified-Since
+		os.Chtimes(page, time.Now(), info.ModTime())
+	}
+}
@@ -13,6 +13,9 @@ import (
 	"runtime"
 	"strconv"
 	"sync"
+	"time"
+
+	"spaceship/pkg"
 )
 
 const (
@@ -24,78 +27,146 @@ const (
 type Fetcher struct {
 	Header http.Header
 	client *http.Client
+	// try times of requests sent by DoWithRetry
+	try     int
+	backoff Backoff
+	// shared by all connections, nil means unlimited
+	limiter *pkg.RateLimiter
 	// inspect response, use WhenInspect or WhenDownload to check when
 	responsePreInspector func(when int, resp *http.Response) error
 }
 
-func (fetcher *Fetcher) inspectWithHead(url string) (supported bool, length int64, err error) {
-	req, err := http.NewRequest(http.MethodHead, url, nil)
-	if err != nil {
-		return
+// Result of Inspect, metadata is taken from the response of the URL after redirects
+type Inspection struct {
+	// whether a slice download is supported
+	Supported bool
+	// -1 if unknown
+	Length int64
+	// final URL after redirects
+	URL string
+	// file name of Content-Disposition, filename* is preferred, it is not sanitized
+	FileName     string
+	ContentType  string
+	ETag         string
+	LastModified time.Time
+	// the server responded 304 to conditions of InspectIfChanged, Supported and Length are unknown
+	NotModified bool
+}
+
+func newInspection(resp *http.Response) *Inspection {
+	info := &Inspection{
+		Length:      -1,
+		URL:         resp.Request.URL.String(),
+		FileName:    ParseContentDisposition(resp.Header.Get("Content-Disposition")),
+		ContentType: resp.Header.Get("Content-Type"),
+		ETag:        resp.Header.Get("ETag"),
+	}
+	info.LastModified, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return info
+}
+
+// 304 response to conditions of v, nil if it is not
+func notModifiedOf(resp *http.Response, v *Validators) *Inspection {
+	if v == nil || resp.StatusCode != http.StatusNotModified {
+		return nil
 	}
-	resp, err := fetcher.Do(req)
+	resp.Body.Close()
+	info := newInspection(resp)
+	info.NotModified = true
+	return info
+}
+
+func (fetcher *Fetcher) inspectWithHead(url string, v *Validators) (*Inspection, error) {
+	resp, err := fetcher.DoWithRetry(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodHead, url, nil)
+		if err == nil && v != nil {
+			v.setConditions(req.Header)
+		}
+		return req, err
+	})
 	if err != nil {
-		return
+		return nil, err
+	}
+	if info := notModifiedOf(resp, v); info != nil {
+		return info, nil
 	}
 	err = fetcher.responsePreInspector(WhenInspect, resp)
 	resp.Body.Close()
 	if err != nil {
-		return
+		return nil, err
 	}
+	info := newInspection(resp)
 	if resp.Header.Get("Accept-Ranges") == "bytes" {
-		supported = true
+		info.Supported = true
 	}
-	contentLength := resp.Header.Get("Content-Length")
-	if contentLength == "" {
-		length = -1
-	} else {
-		length, err = strconv.ParseInt(contentLength, 10, 64)
-		if err != nil {
-			return
+	if contentLength := resp.Header.Get("Content-Length"); contentLength != "" {
+		if info.Length, err = strconv.ParseInt(contentLength, 10, 64); err != nil {
+			return nil, err
 		}
 	}
-	if supported && length < 0 {
-		err = errors.New("supported but length < 0")
+	if info.Supported && info.Length < 0 {
+		return nil, errors.New("supported but length < 0")
 	}
-	return
+	return info, nil
 }
 
-func (fetcher *Fetcher) inspectWithGet(url string) (supported bool, length int64, err error) {
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+func (fetcher *Fetcher) inspectWithGet(url string, v *Validators) (*Inspection, error) {
+	resp, err := fetcher.DoWithRetry(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Range", "bytes=0-0")
+		if v != nil {
+			v.setConditions(req.Header)
+		}
+		return req, nil
+	})
 	if err != nil {
-		return
+		return nil, err
 	}
-	req.Header.Set("Range", "bytes=0-0")
-	resp, err := fetcher.Do(req)
-	if err != nil {
-		return
+	if info := notModifiedOf(resp, v); info != nil {
+		return info, nil
 	}
 	err = fetcher.responsePreInspector(WhenInspect, resp)
 	resp.Body.Close()
 	if err != nil {
-		return
+		return nil, err
 	}
+	info := newInspection(resp)
 	contentRange := resp.Header.Get("Content-Range")
 	if contentRange == "" {
-		supported = false
-		length = -1
-		return
+		return info, nil
 	}
-	supported = true
+	info.Supported = true
 	start, end, length, err := ParseContentRange(contentRange)
+	if err != nil {
+		return nil, err
+	}
 	if start != 0 || end != 0 {
-		err = errors.New("content range start or end is not 0")
+		return nil, errors.New("content range start or end is not 0")
 	}
-	return
+	info.Length = length
+	return info, nil
 }
 
-// Determine if a slice download is supported
-func (fetcher *Fetcher) Inspect(url string) (supported bool, length int64, err error) {
-	supported, length, err = fetcher.inspectWithHead(url)
-	if err != nil || !supported {
-		supported, length, err = fetcher.inspectWithGet(url)
+func (fetcher *Fetcher) inspect(url string, v *Validators) (*Inspection, error) {
+	info, err := fetcher.inspectWithHead(url, v)
+	if err != nil || (!info.Supported && !info.NotModified) {
+		info, err = fetcher.inspectWithGet(url, v)
 	}
-	return
+	return info, err
+}
+
+// Determine if a slice download is supported, and get metadata of the response
+func (fetcher *Fetcher) Inspect(url string) (*Inspection, error) {
+	return fetcher.inspect(url, nil)
+}
+
+// InspectIfChanged is like Inspect, but requests are sent with If-None-Match and If-Modified-Since of v,
+// NotModified of the result is true if the content is not modified since v
+func (fetcher *Fetcher) InspectIfChanged(url string, v *Validators) (*Inspection, error) {
+	return fetcher.inspect(url, v)
 }
 
 type DownloadOption struct {
@@ -103,11 +174,35 @@ type DownloadOption struct {
 	Concurrency int
 	// try times, default 3
 	Try int
+	// minimum chunk size, default 256KB, the remaining range of a chunk is split only if it is at least twice of it
+	ChunkSizeMin int64
+	// maximum chunk size, default 16MB
+	ChunkSizeMax int64
+	// grow or shrink number of connections between 1 and Concurrency by measured throughput
+	AdaptiveConcurrency bool
+	// other URLs of the same content, connections are spread across url and mirrors, see InspectMirrors
+	Mirrors []string
+	// called when a mirror is given up and its ranges are handed to other mirrors, optional
+	OnMirrorFail func(url string, err error)
+	// if not nil, every piece is verified before passed to HookContext, a corrupt piece gives up the mirror
+	// and the range is resumed from another mirror, chunks are aligned to pieces
+	Pieces *Pieces
+	// if not empty, it is sent as If-Range with range requests, see Validators.IfRange, the download aborts
+	// with ErrContentChanged if the content changed. It is sent to mirrors too, so don't use it with mirrors
+	// whose validators differ
+	IfRange string
 	// length is total body length, if length is -1, it is unknown
+	//
+	// r stops at the end of range, end is the end when the range is issued, it may be reduced later
+	// because the rest of a slow range is handed to an idle connection, so r may stop before end
 	HookContext func(ctx context.Context, index int, start, end, length int64, r io.Reader) error
 }
 
 // Download with specified inspect result
+//
+// A failed request is retried with backoff, 429 and 503 responses honour Retry-After.
+// If the body breaks in the middle, the retry resumes from the last byte passed to HookContext,
+// so a writer like FileWriter never writes a byte twice and its WrittenN stays exact.
 func (fetcher *Fetcher) DownloadWithManual(url string, supported bool, length int64, option *DownloadOption) (fatalErr error) {
 	if option == nil {
 		option = &DownloadOption{}
@@ -127,89 +222,194 @@ func (fetcher *Fetcher) DownloadWithManual(url string, supported bool, length in
 	var once sync.Once
 	ctx, cancel := context.WithCancel(option.Context)
 	defer cancel()
+	abort := func(err error) {
+		once.Do(func() {
+			fatalErr = err
+		})
+		cancel()
+	}
 	if length <= 0 {
 		length = -1
 	}
+	if option.Pieces != nil {
+		if length == -1 {
+			option.Pieces = nil
+		} else if err := option.Pieces.check(length); err != nil {
+			return err
+		}
+	}
 	if !supported || length == -1 {
 		option.Concurrency = 1
+		return fetcher.downloadWhole(ctx, url, length, option)
 	}
 
-	size := length / int64(option.Concurrency)
-	// minimum
-	if size < 1024 {
-		size = 1024
+	var align int64
+	if option.Pieces != nil {
+		align = option.Pieces.Length
 	}
-	var count int64
-	var index int
+	s := newRangeScheduler(length, option.Concurrency, option.ChunkSizeMin, option.ChunkSizeMax, align)
+	go func() {
+		<-ctx.Done()
+		s.wake()
+	}()
+	if option.AdaptiveConcurrency {
+		go s.adapt(ctx, time.Second*2)
+	}
+	// connections are spread across mirrors, ranges are pulled by idle connections,
+	// so a faster mirror gets more ranges, and ranges of a failed mirror are resumed from other mirrors
+	mirrors := newMirrorSet(append([]string{url}, option.Mirrors...), option.OnMirrorFail)
 	var wg sync.WaitGroup
-	ch := make(chan struct{}, option.Concurrency)
-	for count < length || length == -1 {
-		var start, end int64
-		if length != -1 || !supported {
-			left := length - count
-			if left > size {
-				start = count
-				count += size
-				end = count - 1
-			} else {
-				start = count
-				count += left
-				end = count - 1
-			}
-		}
+	for id := 0; id < option.Concurrency; id++ {
 		wg.Add(1)
-		go func(index int) {
-			defer func() {
-				wg.Done()
-				<-ch
-			}()
-			ch <- struct{}{}
-			for j := 0; j < option.Try; j++ {
-				req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-				req.Header = fetcher.Header.Clone()
-				if length != -1 && supported {
-					req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+		go func(id int) {
+			defer wg.Done()
+			m := id % len(mirrors.urls)
+			for {
+				c := s.acquire(ctx, id)
+				if c == nil {
+					return
 				}
-				resp, err := fetcher.client.Do(req)
-				if err == nil {
-					err = fetcher.responsePreInspector(WhenDownload, resp)
+				err := fetcher.downloadChunk(ctx, mirrors.urls[m], length, s, c, option)
+				for err != nil && ctx.Err() == nil && !errors.As(err, new(*hookError)) {
+					var ok bool
+					if m, ok = mirrors.fail(m, err); !ok {
+						break
+					}
+					err = fetcher.downloadChunk(ctx, mirrors.urls[m], length, s, c, option)
 				}
+				s.release(c)
 				if err != nil {
-					if j == option.Try-1 {
-						once.Do(func() {
-							fatalErr = err
-						})
-						cancel()
-						return
-					}
-					continue
+					abort(unwrapHookError(err))
+					return
 				}
-				if err := option.HookContext(ctx, index, start, end, length, resp.Body); err != nil {
-					once.Do(func() {
-						fatalErr = err
-					})
-					cancel()
+				// another connection may have given up this mirror
+				var ok bool
+				if m, ok = mirrors.next(m); !ok {
+					return
 				}
-				resp.Body.Close()
-				break
 			}
-		}(index)
-		index++
-		if length == -1 {
-			break
-		}
+		}(id)
 	}
 	wg.Wait()
 	return
 }
 
+// send GET request with optional range and If-Range, the response is checked by responsePreInspector
+func (fetcher *Fetcher) get(ctx context.Context, url string, rangeStart, rangeEnd int64, ifRange string) (*http.Response, error) {
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	req.Header = fetcher.Header.Clone()
+	if rangeStart >= 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", rangeStart, rangeEnd))
+		if ifRange != "" {
+			req.Header.Set("If-Range", ifRange)
+		}
+	}
+	resp, err := fetcher.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRetryableStatus(resp); err != nil {
+		return nil, err
+	}
+	if err := fetcher.responsePreInspector(WhenDownload, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// body of response limited by rate limiter, and verified by pieces if pieces is not nil
+func (fetcher *Fetcher) bodyOf(ctx context.Context, resp *http.Response, pieces *Pieces, offset, length int64) io.Reader {
+	r := pkg.NewRateLimitedReader(ctx, resp.Body, fetcher.limiter)
+	if pieces != nil {
+		r = newPieceReader(r, pieces, offset, length)
+	}
+	return r
+}
+
+// download body without range, it can't resume, so it is retried only if nothing was read
+func (fetcher *Fetcher) downloadWhole(ctx context.Context, url string, length int64, option *DownloadOption) error {
+	for j := 0; ; j++ {
+		resp, err := fetcher.get(ctx, url, -1, -1, "")
+		if err == nil {
+			br := &bodyReader{r: fetcher.bodyOf(ctx, resp, option.Pieces, 0, length)}
+			if length == -1 {
+				err = option.HookContext(ctx, 0, 0, 0, length, br)
+				resp.Body.Close()
+				if err == nil {
+					return nil
+				}
+			} else {
+				s := newRangeScheduler(length, 1, length, length, 0)
+				c := s.add(0, length-1)
+				cr := &chunkReader{s: s, c: c, r: br}
+				err = option.HookContext(ctx, c.index, c.start, c.end, length, cr)
+				resp.Body.Close()
+				if err == nil {
+					return cr.check()
+				}
+			}
+			if br.err == nil || br.n > 0 {
+				return err
+			}
+		}
+		if j >= option.Try-1 || ctx.Err() != nil || !fetcher.waitRetry(ctx, j, err) {
+			return err
+		}
+	}
+}
+
+// download a chunk, try option.Try times if request failed, attempts are reset when some bytes were read
+func (fetcher *Fetcher) downloadChunk(ctx context.Context, url string, length int64, s *rangeScheduler, c *chunk, option *DownloadOption) error {
+	for j := 0; ; j++ {
+		pos, end := s.remaining(c)
+		if pos > end {
+			return nil
+		}
+		resp, err := fetcher.get(ctx, url, pos, end, option.IfRange)
+		// whole content is written at pos if the server ignores the range
+		if err == nil && resp.StatusCode != http.StatusPartialContent {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK && option.IfRange != "" {
+				return &hookError{ErrContentChanged}
+			}
+			err = fmt.Errorf("unexpected status \"%s\" of range request", resp.Status)
+		}
+		if err == nil {
+			br := &bodyReader{r: fetcher.bodyOf(ctx, resp, option.Pieces, pos, length)}
+			cr := &chunkReader{s: s, c: c, r: br}
+			err = option.HookContext(ctx, c.index, pos, end, length, cr)
+			resp.Body.Close()
+			if err == nil {
+				if err = cr.check(); err != nil {
+					return &hookError{err}
+				}
+				return nil
+			}
+			// error of hook itself
+			if br.err == nil {
+				return &hookError{err}
+			}
+			// a corrupt piece will be served again by the same server
+			if errors.As(br.err, new(*PieceError)) {
+				return br.err
+			}
+			if br.n > 0 {
+				j = -1
+			}
+		}
+		if j >= option.Try-1 || ctx.Err() != nil || !fetcher.waitRetry(ctx, j, err) {
+			return err
+		}
+	}
+}
+
 // Download and auto inspect
 func (fetcher *Fetcher) Download(url string, option *DownloadOption) error {
-	supported, length, err := fetcher.Inspect(url)
+	info, err := fetcher.Inspect(url)
 	if err != nil {
 		return err
 	}
-	return fetcher.DownloadWithManual(url, supported, length, option)
+	return fetcher.DownloadWithManual(url, info.Supported, info.Length, option)
 }
 
 // send request via Fetcher.client, Fetcher.Header will be merged
@@ -236,6 +436,19 @@ type FetcherOption struct {
 	ResolveHostMap       map[string]string
 	RootCAs              *x509.CertPool
 	ResponsePreInspector func(when int, resp *http.Response) error
+	// try times of inspecting and other requests sent by DoWithRetry, default 3
+	Try int
+	// delay between retries, also used by downloads
+	Backoff Backoff
+	// bytes per second of all downloads of this fetcher, 0 means unlimited
+	LimitRate int64
+	// maximum connections per host of all downloads of this fetcher, 0 means unlimited
+	MaxConnsPerHost int
+	// a new in-memory jar is used if nil
+	Jar http.CookieJar
+	// credentials by origin like "https://example.com:443" or URL, they are only sent to their origins,
+	// not to other hosts, schemes or ports after redirects
+	Credentials map[string]*Credentials
 }
 
 func NewFetcher(option FetcherOption) (*Fetcher, error) {
@@ -244,9 +457,14 @@ func NewFetcher(option FetcherOption) (*Fetcher, error) {
 		responsePreInspector = func(when int, resp *http.Response) error { return nil }
 	}
 
+	try := option.Try
+	if try <= 0 {
+		try = 3
+	}
+
 	transport := http.DefaultTransport.(*http.Transport).Clone()
-	// unlimit
-	transport.MaxConnsPerHost = 0
+	// unlimit by default
+	transport.MaxConnsPerHost = option.MaxConnsPerHost
 	transport.MaxIdleConns = 0
 	transport.MaxIdleConnsPerHost = 10000
 	transport.TLSClientConfig = &tls.Config{
@@ -271,9 +489,16 @@ func NewFetcher(option FetcherOption) (*Fetcher, error) {
 		}
 	}
 
-	jar, _ := cookiejar.New(nil)
+	jar := option.Jar
+	if jar == nil {
+		jar, _ = cookiejar.New(nil)
+	}
+	var roundTripper http.RoundTripper = transport
+	if len(option.Credentials) > 0 {
+		roundTripper = newAuthTransport(transport, option.Credentials)
+	}
 	client := &http.Client{
-		Transport: transport,
+		Transport: roundTripper,
 		Jar:       jar,
 	}
 	if option.DisallowRedirects {
@@ -300,6 +525,21 @@ func NewFetcher(option FetcherOption) (*Fetcher, error) {
 				ua,
 			},
 		},
-		client: client,
+		client:  client,
+		try:     try,
+		backoff: option.Backoff.withDefault(),
+		limiter: pkg.NewRateLimiter(option.LimitRate),
 	}, nil
 }
+
+// rate limiter shared by all downloads, it can be used by uploads too, nil means unlimited
+func (fetcher *Fetcher) RateLimiter() *pkg.RateLimiter {
+	return fetcher.limiter
+}
+
+// Clone returns a fetcher with a copy of Header, the client, rate limiter and other options are shared
+func (fetcher *Fetcher) Clone() *Fetcher {
+	clone := *fetcher
+	clone.Header = fetcher.Header.Clone()
+	return &clone
+}
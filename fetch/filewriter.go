@@ -3,24 +3,72 @@ package fetch
 import (
 	"context"
 	"errors"
-	"fmt"
 	"io"
 	"io/fs"
-	"os"
+	"sort"
+	"sync"
 	"sync/atomic"
 )
 
-type FileWriter struct {
-	f             *os.File
+// Writer writes ranges passed to HookContext into a Sink and keeps track of written ranges
+type Writer struct {
+	sink          Sink
+	preallocate   sync.Once
 	writtenN      int64
 	writeListener func(n int, index int, start, end, length int64)
+	// written ranges
+	l       sync.Mutex
+	written intervals
 }
 
-func (fw *FileWriter) HookContext(ctx context.Context, index int, start, end, length int64, r io.Reader) error {
+// FileWriter is Writer of a FileSink, it is kept for compatibility
+type FileWriter = Writer
+
+// sorted and merged [start, end) ranges
+type intervals [][2]int64
+
+func (s intervals) add(start, end int64) intervals {
+	i := sort.Search(len(s), func(i int) bool { return s[i][1] >= start })
+	j := i
+	for j < len(s) && s[j][0] <= end {
+		if s[j][0] < start {
+			start = s[j][0]
+		}
+		if s[j][1] > end {
+			end = s[j][1]
+		}
+		j++
+	}
+	if i == j {
+		s = append(s, [2]int64{})
+		copy(s[i+1:], s[i:])
+		s[i] = [2]int64{start, end}
+		return s
+	}
+	s[i] = [2]int64{start, end}
+	return append(s[:i+1], s[j:]...)
+}
+
+// Sink of the writer, for example, MemorySink to get the content
+func (fw *Writer) Sink() Sink {
+	return fw.sink
+}
+
+func (fw *Writer) HookContext(ctx context.Context, index int, start, end, length int64, r io.Reader) error {
 	bs := make([]byte, 1024*16)
 	if length != -1 {
 		r = io.LimitReader(r, end-start+1)
+		var err error
+		fw.preallocate.Do(func() {
+			if p, ok := fw.sink.(Preallocator); ok {
+				err = p.Preallocate(length)
+			}
+		})
+		if err != nil {
+			return err
+		}
 	}
+	cw, _ := fw.sink.(contextWriterAt)
 	var count int64
 	for {
 		select {
@@ -30,10 +78,19 @@ func (fw *FileWriter) HookContext(ctx context.Context, index int, start, end, le
 		}
 		n, err := r.Read(bs)
 		if n > 0 {
-			if _, err := fw.f.WriteAt(bs[:n], start+count); err != nil {
+			var err error
+			if cw != nil {
+				_, err = cw.writeAtContext(ctx, bs[:n], start+count)
+			} else {
+				_, err = fw.sink.WriteAt(bs[:n], start+count)
+			}
+			if err != nil {
 				return err
 			}
 			atomic.AddInt64(&fw.writtenN, int64(n))
+			fw.l.Lock()
+			fw.written = fw.written.add(start+count, start+count+int64(n))
+			fw.l.Unlock()
 			if fw.writeListener != nil {
 				fw.writeListener(n, index, start, end, length)
 			}
@@ -48,33 +105,55 @@ func (fw *FileWriter) HookContext(ctx context.Context, index int, start, end, le
 			}
 		}
 	}
-	if length != -1 && count != end-start+1 {
-		return fmt.Errorf("index: %d, start: %d, end: %d, read count %d not equal %d", index, start, end, count, end-start+1)
-	}
+	// r may stop before end if the range was split, whether the range is complete is checked by Fetcher
 	return nil
 }
-func (fh *FileWriter) OnWrite(cb func(n int, index int, start, end, length int64)) {
+func (fh *Writer) OnWrite(cb func(n int, index int, start, end, length int64)) {
 	fh.writeListener = cb
 }
-func (fh *FileWriter) WrittenN() int64 {
+func (fh *Writer) WrittenN() int64 {
 	return atomic.LoadInt64(&fh.writtenN)
 }
-func (fh *FileWriter) Truncate(size int64) error {
-	return fh.f.Truncate(size)
+
+// Prefix returns length of contiguous written part from offset 0
+func (fh *Writer) Prefix() int64 {
+	fh.l.Lock()
+	defer fh.l.Unlock()
+	if len(fh.written) == 0 || fh.written[0][0] != 0 {
+		return 0
+	}
+	return fh.written[0][1]
 }
-func (fh *FileWriter) Close() error {
-	return fh.f.Close()
+
+// Name returns name of the file, empty if the sink is not a file
+func (fh *Writer) Name() string {
+	if f, ok := fh.sink.(*FileSink); ok {
+		return f.Name()
+	}
+	return ""
 }
 
-func NewFileWriter(name string, perm ...fs.FileMode) (*FileWriter, error) {
-	if len(perm) == 0 {
-		perm = append(perm, 0666)
+// Truncate sets the final size after download, it is no-op if the sink can't be truncated
+func (fh *Writer) Truncate(size int64) error {
+	if t, ok := fh.sink.(Truncater); ok {
+		return t.Truncate(size)
+	}
+	return nil
+}
+func (fh *Writer) Close() error {
+	return fh.sink.Close()
+}
+
+func NewWriter(sink Sink) *Writer {
+	return &Writer{
+		sink: sink,
 	}
-	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY, perm[0])
+}
+
+func NewFileWriter(name string, perm ...fs.FileMode) (*FileWriter, error) {
+	f, err := NewFileSink(name, perm...)
 	if err != nil {
 		return nil, err
 	}
-	return &FileWriter{
-		f: f,
-	}, nil
+	return NewWriter(f), nil
 }
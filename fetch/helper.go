@@ -3,14 +3,21 @@ package fetch
 import (
 	"context"
 	"errors"
+	"mime"
 	"net"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
 )
 
-var contentRangeRegex = regexp.MustCompile(`^bytes (\d+)-(\d+)/(\d+)$`)
+var (
+	contentRangeRegex = regexp.MustCompile(`^bytes (\d+)-(\d+)/(\d+)$`)
+	// fallbacks for malformed Content-Disposition, such as unquoted spaces
+	dispositionExtRegex = regexp.MustCompile(`(?i)filename\*\s*=\s*(utf-8|iso-8859-1)'[^']*'([^;\s]+)`)
+	dispositionRegex    = regexp.MustCompile(`(?i)filename\s*=\s*(?:"([^"]*)"|([^;]+))`)
+)
 
 func ParseContentRange(s string) (start, end, size int64, err error) {
 	s = strings.TrimSpace(s)
@@ -39,6 +46,34 @@ func ParseContentRange(s string) (start, end, size int64, err error) {
 	return start, end, size, nil
 }
 
+// ParseContentDisposition returns file name of Content-Disposition, filename* of RFC 5987 is preferred,
+// empty if absent, the name is not sanitized
+func ParseContentDisposition(s string) string {
+	if strings.TrimSpace(s) == "" {
+		return ""
+	}
+	// filename* of charsets other than UTF-8 is dropped by mime, so fall through if the name is empty
+	if _, params, err := mime.ParseMediaType(s); err == nil && params["filename"] != "" {
+		return params["filename"]
+	}
+	if m := dispositionExtRegex.FindStringSubmatch(s); m != nil {
+		if name, err := url.PathUnescape(m[2]); err == nil {
+			if strings.EqualFold(m[1], "iso-8859-1") {
+				runes := make([]rune, len(name))
+				for i := 0; i < len(name); i++ {
+					runes[i] = rune(name[i])
+				}
+				name = string(runes)
+			}
+			return name
+		}
+	}
+	if m := dispositionRegex.FindStringSubmatch(s); m != nil {
+		return strings.TrimSpace(m[1] + m[2])
+	}
+	return ""
+}
+
 // map:  hostname(* match all) => ip
 func GetDialContextWithHosts(resolveHostMap map[string]string, dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
 	if dialer == nil {
@@ -0,0 +1,496 @@
+package fetch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"spaceship/pkg"
+)
+
+// Variant stream of HLS master playlist
+type HLSVariant struct {
+	URL       string
+	Bandwidth int64
+	// 0 if resolution is absent
+	Width  int
+	Height int
+	Codecs string
+}
+
+// Encryption of segments, only AES-128 is supported
+type HLSKey struct {
+	// NONE, AES-128 or SAMPLE-AES
+	Method string
+	URL    string
+	// nil means media sequence number is used as IV
+	IV []byte
+}
+
+type HLSSegment struct {
+	URL      string
+	Duration float64
+	Sequence int64
+	// nil if not encrypted
+	Key *HLSKey
+	// byte range of resource, Length is -1 if whole resource is the segment
+	Offset int64
+	Length int64
+}
+
+// Master playlist has variants, media playlist has segments
+type HLSPlaylist struct {
+	Variants []*HLSVariant
+	Segments []*HLSSegment
+	// media initialization section of EXT-X-MAP, nil if absent
+	Map *HLSSegment
+	// EXT-X-ENDLIST is present, a live playlist without it may get more segments later
+	Ended bool
+}
+
+func (p *HLSPlaylist) IsMaster() bool {
+	return len(p.Variants) > 0
+}
+
+// parse attribute list like `METHOD=AES-128,URI="key.bin",IV=0x01`, keys are upper case
+func parseHLSAttributes(s string) map[string]string {
+	attrs := make(map[string]string)
+	for len(s) > 0 {
+		eq := strings.Index(s, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToUpper(strings.TrimSpace(s[:eq]))
+		s = s[eq+1:]
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.Index(s[1:], `"`)
+			if end < 0 {
+				value, s = s[1:], ""
+			} else {
+				value, s = s[1:end+1], s[end+2:]
+			}
+		} else if comma := strings.Index(s, ","); comma > -1 {
+			value, s = s[:comma], s[comma:]
+		} else {
+			value, s = s, ""
+		}
+		attrs[key] = strings.TrimSpace(value)
+		s = strings.TrimPrefix(strings.TrimSpace(s), ",")
+	}
+	return attrs
+}
+
+// parse "<length>[@<offset>]", offset is -1 if absent
+func parseHLSByteRange(s string) (length, offset int64, err error) {
+	offset = -1
+	if i := strings.Index(s, "@"); i > -1 {
+		if offset, err = strconv.ParseInt(strings.TrimSpace(s[i+1:]), 10, 64); err != nil {
+			return
+		}
+		s = s[:i]
+	}
+	length, err = strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	return
+}
+
+func resolveHLSURL(base *url.URL, ref string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(ref))
+	if err != nil {
+		return "", err
+	}
+	if base == nil {
+		return u.String(), nil
+	}
+	return base.ResolveReference(u).String(), nil
+}
+
+// ParseHLSPlaylist parses master or media playlist, relative URIs are resolved against base
+func ParseHLSPlaylist(r io.Reader, base *url.URL) (*HLSPlaylist, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	playlist := &HLSPlaylist{}
+	var (
+		lineNo   int
+		sequence int64
+		key      *HLSKey
+		variant  *HLSVariant
+		duration float64
+		// byte range of next segment
+		rangeLength int64 = -1
+		rangeOffset int64 = -1
+		// end of previous byte range for each URI, used when offset is absent
+		lastEnd = make(map[string]int64)
+	)
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if lineNo == 1 {
+			if line != "#EXTM3U" {
+				return nil, errors.New("not a m3u8 playlist, missing #EXTM3U")
+			}
+			continue
+		}
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "#") {
+			u, err := resolveHLSURL(base, line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			if variant != nil {
+				variant.URL = u
+				playlist.Variants = append(playlist.Variants, variant)
+				variant = nil
+				continue
+			}
+			segment := &HLSSegment{URL: u, Duration: duration, Sequence: sequence, Key: key, Length: -1}
+			if rangeLength >= 0 {
+				segment.Length = rangeLength
+				segment.Offset = rangeOffset
+				if segment.Offset < 0 {
+					segment.Offset = lastEnd[u]
+				}
+				lastEnd[u] = segment.Offset + segment.Length
+			}
+			playlist.Segments = append(playlist.Segments, segment)
+			sequence++
+			duration, rangeLength, rangeOffset = 0, -1, -1
+			continue
+		}
+		tag, value, _ := strings.Cut(line, ":")
+		switch tag {
+		case "#EXT-X-STREAM-INF":
+			attrs := parseHLSAttributes(value)
+			variant = &HLSVariant{Codecs: attrs["CODECS"]}
+			variant.Bandwidth, _ = strconv.ParseInt(attrs["BANDWIDTH"], 10, 64)
+			if w, h, ok := strings.Cut(strings.ToLower(attrs["RESOLUTION"]), "x"); ok {
+				variant.Width, _ = strconv.Atoi(w)
+				variant.Height, _ = strconv.Atoi(h)
+			}
+		case "#EXT-X-MEDIA-SEQUENCE":
+			n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid media sequence %s", lineNo, value)
+			}
+			sequence = n
+		case "#EXTINF":
+			d, _, _ := strings.Cut(value, ",")
+			duration, _ = strconv.ParseFloat(strings.TrimSpace(d), 64)
+		case "#EXT-X-BYTERANGE":
+			var err error
+			if rangeLength, rangeOffset, err = parseHLSByteRange(value); err != nil {
+				return nil, fmt.Errorf("line %d: invalid byte range %s", lineNo, value)
+			}
+		case "#EXT-X-KEY":
+			attrs := parseHLSAttributes(value)
+			method := strings.ToUpper(attrs["METHOD"])
+			if method == "NONE" || method == "" {
+				key = nil
+				continue
+			}
+			key = &HLSKey{Method: method}
+			if attrs["URI"] != "" {
+				u, err := resolveHLSURL(base, attrs["URI"])
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w", lineNo, err)
+				}
+				key.URL = u
+			}
+			if iv := attrs["IV"]; iv != "" {
+				bs, err := hex.DecodeString(strings.TrimPrefix(strings.TrimPrefix(iv, "0x"), "0X"))
+				if err != nil || len(bs) > aes.BlockSize {
+					return nil, fmt.Errorf("line %d: invalid IV %s", lineNo, iv)
+				}
+				key.IV = make([]byte, aes.BlockSize)
+				copy(key.IV[aes.BlockSize-len(bs):], bs)
+			}
+		case "#EXT-X-MAP":
+			attrs := parseHLSAttributes(value)
+			u, err := resolveHLSURL(base, attrs["URI"])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			playlist.Map = &HLSSegment{URL: u, Length: -1}
+			if br := attrs["BYTERANGE"]; br != "" {
+				length, offset, err := parseHLSByteRange(br)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: invalid byte range %s", lineNo, br)
+				}
+				if offset < 0 {
+					offset = 0
+				}
+				playlist.Map.Length, playlist.Map.Offset = length, offset
+			}
+		case "#EXT-X-ENDLIST":
+			playlist.Ended = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if lineNo == 0 {
+		return nil, errors.New("empty playlist")
+	}
+	return playlist, nil
+}
+
+// FetchHLSPlaylist downloads and parses playlist, relative URIs are resolved against the URL after redirects
+func (fetcher *Fetcher) FetchHLSPlaylist(rawURL string) (*HLSPlaylist, error) {
+	resp, err := fetcher.DoWithRetry(func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, rawURL, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status \"%s\" of %s", resp.Status, rawURL)
+	}
+	return ParseHLSPlaylist(resp.Body, resp.Request.URL)
+}
+
+// SelectHLSVariant selects variant by spec: "best" or "" for the highest bandwidth, "worst" for the lowest,
+// "<height>p" or "<width>x<height>" for resolution, or a number for the highest bandwidth not greater than it
+func SelectHLSVariant(variants []*HLSVariant, spec string) (*HLSVariant, error) {
+	if len(variants) == 0 {
+		return nil, errors.New("no variant")
+	}
+	sorted := append([]*HLSVariant{}, variants...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Bandwidth < sorted[j].Bandwidth
+	})
+	spec = strings.ToLower(strings.TrimSpace(spec))
+	switch {
+	case spec == "" || spec == "best":
+		return sorted[len(sorted)-1], nil
+	case spec == "worst":
+		return sorted[0], nil
+	case strings.HasSuffix(spec, "p"):
+		height, err := strconv.Atoi(strings.TrimSuffix(spec, "p"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid variant %s", spec)
+		}
+		for i := len(sorted) - 1; i >= 0; i-- {
+			if sorted[i].Height == height {
+				return sorted[i], nil
+			}
+		}
+		return nil, fmt.Errorf("no variant of resolution %s", spec)
+	case strings.Contains(spec, "x"):
+		w, h, _ := strings.Cut(spec, "x")
+		width, err1 := strconv.Atoi(w)
+		height, err2 := strconv.Atoi(h)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid variant %s", spec)
+		}
+		for i := len(sorted) - 1; i >= 0; i-- {
+			if sorted[i].Width == width && sorted[i].Height == height {
+				return sorted[i], nil
+			}
+		}
+		return nil, fmt.Errorf("no variant of resolution %s", spec)
+	default:
+		bandwidth, err := pkg.ParseSize(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid variant %s", spec)
+		}
+		for i := len(sorted) - 1; i >= 0; i-- {
+			if sorted[i].Bandwidth <= bandwidth {
+				return sorted[i], nil
+			}
+		}
+		return nil, fmt.Errorf("no variant of bandwidth not greater than %d", bandwidth)
+	}
+}
+
+type HLSOption struct {
+	Context context.Context
+	// number of segments downloaded at the same time, default 8
+	Concurrency int
+	// called after a segment is written, n is its decrypted size
+	OnSegment func(index int, n int)
+}
+
+// DownloadHLS downloads segments of media playlist concurrently, decrypts AES-128 segments
+// and writes them to w in order, the initialization section of EXT-X-MAP is written first
+func (fetcher *Fetcher) DownloadHLS(playlist *HLSPlaylist, w io.Writer, option *HLSOption) error {
+	if option == nil {
+		option = &HLSOption{}
+	}
+	if option.Concurrency <= 0 {
+		option.Concurrency = 8
+	}
+	if option.Context == nil {
+		option.Context = context.Background()
+	}
+	if playlist.IsMaster() {
+		return errors.New("master playlist has no segments, select a variant first")
+	}
+	segments := playlist.Segments
+	if playlist.Map != nil {
+		segments = append([]*HLSSegment{playlist.Map}, segments...)
+	}
+	for _, segment := range segments {
+		if segment.Key != nil && segment.Key.Method != "AES-128" {
+			return fmt.Errorf("unsupported encryption method %s", segment.Key.Method)
+		}
+	}
+	ctx, cancel := context.WithCancel(option.Context)
+	defer cancel()
+	keys := &hlsKeyCache{fetcher: fetcher, keys: make(map[string][]byte)}
+	type result struct {
+		data []byte
+		err  error
+	}
+	results := make([]chan result, len(segments))
+	for i := range results {
+		results[i] = make(chan result, 1)
+	}
+	// segments downloaded but not written are limited, so memory is bounded
+	window := make(chan struct{}, option.Concurrency*2)
+	sem := make(chan struct{}, option.Concurrency)
+	go func() {
+		for i, segment := range segments {
+			select {
+			case window <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			sem <- struct{}{}
+			go func(i int, segment *HLSSegment) {
+				defer func() { <-sem }()
+				data, err := fetcher.downloadSegment(ctx, segment, keys)
+				results[i] <- result{data, err}
+			}(i, segment)
+		}
+	}()
+	for i := range segments {
+		var r result
+		select {
+		case r = <-results[i]:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if r.err != nil {
+			return fmt.Errorf("segment %d %s: %w", i, segments[i].URL, r.err)
+		}
+		if _, err := w.Write(r.data); err != nil {
+			return err
+		}
+		<-window
+		if option.OnSegment != nil {
+			option.OnSegment(i, len(r.data))
+		}
+	}
+	return nil
+}
+
+// keys are fetched once and shared by segments
+type hlsKeyCache struct {
+	l       sync.Mutex
+	fetcher *Fetcher
+	keys    map[string][]byte
+}
+
+func (kc *hlsKeyCache) get(ctx context.Context, keyURL string) ([]byte, error) {
+	kc.l.Lock()
+	defer kc.l.Unlock()
+	if key, ok := kc.keys[keyURL]; ok {
+		return key, nil
+	}
+	key, err := kc.fetcher.getWithRetry(ctx, keyURL, 0, -1, "")
+	if err != nil {
+		return nil, fmt.Errorf("fetch key %s: %w", keyURL, err)
+	}
+	if len(key) != aes.BlockSize {
+		return nil, fmt.Errorf("key %s is %d bytes, expected %d", keyURL, len(key), aes.BlockSize)
+	}
+	kc.keys[keyURL] = key
+	return key, nil
+}
+
+func (fetcher *Fetcher) downloadSegment(ctx context.Context, segment *HLSSegment, keys *hlsKeyCache) ([]byte, error) {
+	data, err := fetcher.getWithRetry(ctx, segment.URL, segment.Offset, segment.Length, "")
+	if err != nil || segment.Key == nil {
+		return data, err
+	}
+	key, err := keys.get(ctx, segment.Key.URL)
+	if err != nil {
+		return nil, err
+	}
+	iv := segment.Key.IV
+	if iv == nil {
+		iv = make([]byte, aes.BlockSize)
+		binary.BigEndian.PutUint64(iv[8:], uint64(segment.Sequence))
+	}
+	return decryptAES128(data, key, iv)
+}
+
+// AES-128-CBC with PKCS7 padding
+func decryptAES128(data, key, iv []byte) ([]byte, error) {
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("encrypted size %d is not a multiple of block size", len(data))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+	// PKCS7, all of the last pad bytes are pad
+	pad := out[len(out)-1]
+	if pad == 0 || pad > aes.BlockSize || !bytes.Equal(out[len(out)-int(pad):], bytes.Repeat([]byte{pad}, int(pad))) {
+		return nil, errors.New("invalid padding, the key may be wrong")
+	}
+	return out[:len(out)-int(pad)], nil
+}
+
+// get body of url into memory, length -1 means whole body, the request is retried with backoff if it failed,
+// ifRange is sent with the range request if not empty
+func (fetcher *Fetcher) getWithRetry(ctx context.Context, url string, offset, length int64, ifRange string) ([]byte, error) {
+	for j := 0; ; j++ {
+		var resp *http.Response
+		var err error
+		if length >= 0 {
+			resp, err = fetcher.get(ctx, url, offset, offset+length-1, ifRange)
+		} else {
+			resp, err = fetcher.get(ctx, url, -1, -1, "")
+		}
+		var data []byte
+		if err == nil {
+			if length >= 0 && resp.StatusCode != http.StatusPartialContent {
+				resp.Body.Close()
+				if resp.StatusCode == http.StatusOK && ifRange != "" {
+					return nil, ErrContentChanged
+				}
+				return nil, fmt.Errorf("unexpected status \"%s\" of range request", resp.Status)
+			}
+			data, err = io.ReadAll(pkg.NewRateLimitedReader(ctx, resp.Body, fetcher.limiter))
+			resp.Body.Close()
+			if err == nil && length >= 0 && int64(len(data)) != length {
+				err = io.ErrUnexpectedEOF
+			}
+			if err == nil {
+				return data, nil
+			}
+		}
+		if j >= fetcher.try-1 || ctx.Err() != nil || !fetcher.waitRetry(ctx, j, err) {
+			return nil, err
+		}
+	}
+}
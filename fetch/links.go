@@ -0,0 +1,256 @@
+package fetch
+
+import (
+	"bytes"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// link found in HTML or CSS
+type pageLink struct {
+	URL *url.URL
+	// resource needed to display the page, like image, script and style sheet, otherwise a link to navigate
+	Requisite bool
+}
+
+// attributes containing URLs, value is whether the resource is a page requisite
+var linkAttributes = map[string]map[string]bool{
+	"a":      {"href": false},
+	"area":   {"href": false},
+	"iframe": {"src": false},
+	"frame":  {"src": false},
+	"link":   {"href": true},
+	"img":    {"src": true, "srcset": true},
+	"script": {"src": true},
+	"source": {"src": true, "srcset": true},
+	"video":  {"src": true, "poster": true},
+	"audio":  {"src": true},
+	"track":  {"src": true},
+	"embed":  {"src": true},
+	"object": {"data": true},
+	"input":  {"src": true},
+	"body":   {"background": true},
+}
+
+var (
+	cssURLRegex    = regexp.MustCompile(`url\(\s*(?:'([^']*)'|"([^"]*)"|([^)'"\s]*))\s*\)`)
+	cssImportRegex = regexp.MustCompile(`@import\s+(?:'([^']*)'|"([^"]*)")`)
+)
+
+// split srcset like "a.png 1x, b.png 2x" into URLs
+func splitSrcset(v string) []string {
+	var urls []string
+	for _, item := range strings.Split(v, ",") {
+		if fields := strings.Fields(item); len(fields) > 0 {
+			urls = append(urls, fields[0])
+		}
+	}
+	return urls
+}
+
+func resolveLink(base *url.URL, ref string) *url.URL {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || strings.HasPrefix(ref, "#") {
+		return nil
+	}
+	u, err := base.Parse(ref)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil
+	}
+	u.Fragment = ""
+	u.RawFragment = ""
+	return u
+}
+
+// all URLs in CSS, they are all page requisites
+func extractCSSLinks(css []byte, base *url.URL) []pageLink {
+	var links []pageLink
+	for _, re := range []*regexp.Regexp{cssURLRegex, cssImportRegex} {
+		for _, m := range re.FindAllSubmatch(css, -1) {
+			for _, g := range m[1:] {
+				if len(g) == 0 {
+					continue
+				}
+				if u := resolveLink(base, string(g)); u != nil {
+					links = append(links, pageLink{URL: u, Requisite: true})
+				}
+			}
+		}
+	}
+	return links
+}
+
+// all URLs in HTML, <base href> is honoured
+func extractHTMLLinks(content []byte, base *url.URL) []pageLink {
+	var links []pageLink
+	z := html.NewTokenizer(bytes.NewReader(content))
+	inStyle := false
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			return links
+		case html.TextToken:
+			if inStyle {
+				links = append(links, extractCSSLinks(z.Text(), base)...)
+			}
+		case html.EndTagToken:
+			if name, _ := z.TagName(); string(name) == "style" {
+				inStyle = false
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			t := z.Token()
+			if t.Data == "style" && tt == html.StartTagToken {
+				inStyle = true
+			}
+			attrs := linkAttributes[t.Data]
+			for _, attr := range t.Attr {
+				if t.Data == "base" && attr.Key == "href" {
+					if u, err := base.Parse(strings.TrimSpace(attr.Val)); err == nil {
+						base = u
+					}
+					continue
+				}
+				if attr.Key == "style" {
+					links = append(links, extractCSSLinks([]byte(attr.Val), base)...)
+					continue
+				}
+				requisite, ok := attrs[attr.Key]
+				if !ok {
+					continue
+				}
+				// only style sheets and icons of <link> are requisites, others like "next" are pages
+				if t.Data == "link" {
+					rel := strings.ToLower(attrValue(t, "rel"))
+					requisite = strings.Contains(rel, "stylesheet") || strings.Contains(rel, "icon") || strings.Contains(rel, "preload")
+				}
+				values := []string{attr.Val}
+				if attr.Key == "srcset" {
+					values = splitSrcset(attr.Val)
+				}
+				for _, v := range values {
+					if u := resolveLink(base, v); u != nil {
+						links = append(links, pageLink{URL: u, Requisite: requisite})
+					}
+				}
+			}
+		}
+	}
+}
+
+func attrValue(t html.Token, key string) string {
+	for _, attr := range t.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+// replace a reference by mapping, fragment of the reference is kept
+func rewriteRef(base *url.URL, ref string, mapping func(u *url.URL) string) string {
+	trimmed := strings.TrimSpace(ref)
+	if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+		return ref
+	}
+	u, err := base.Parse(trimmed)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ref
+	}
+	fragment := u.EscapedFragment()
+	u.Fragment = ""
+	u.RawFragment = ""
+	s := mapping(u)
+	if fragment != "" {
+		s += "#" + fragment
+	}
+	return s
+}
+
+func rewriteCSS(css []byte, base *url.URL, mapping func(u *url.URL) string) []byte {
+	replace := func(re *regexp.Regexp, format string) {
+		css = re.ReplaceAllFunc(css, func(m []byte) []byte {
+			sub := re.FindSubmatch(m)
+			for _, g := range sub[1:] {
+				if len(g) > 0 {
+					return []byte(strings.Replace(format, "%s", rewriteRef(base, string(g), mapping), 1))
+				}
+			}
+			return m
+		})
+	}
+	replace(cssURLRegex, `url("%s")`)
+	replace(cssImportRegex, `@import "%s"`)
+	return css
+}
+
+// rewrite URLs in HTML by mapping, untouched tokens are kept as they are
+func rewriteHTML(content []byte, base *url.URL, mapping func(u *url.URL) string) []byte {
+	var buf bytes.Buffer
+	z := html.NewTokenizer(bytes.NewReader(content))
+	inStyle := false
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			return buf.Bytes()
+		case html.TextToken:
+			if inStyle {
+				buf.Write(rewriteCSS(append([]byte{}, z.Raw()...), base, mapping))
+				continue
+			}
+		case html.EndTagToken:
+			if name, _ := z.TagName(); string(name) == "style" {
+				inStyle = false
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			raw := append([]byte{}, z.Raw()...)
+			t := z.Token()
+			if t.Data == "style" && tt == html.StartTagToken {
+				inStyle = true
+			}
+			// links are rewritten to absolute or relative to the local file, so <base> is dropped
+			if t.Data == "base" {
+				if u, err := base.Parse(strings.TrimSpace(attrValue(t, "href"))); err == nil {
+					base = u
+				}
+				continue
+			}
+			attrs := linkAttributes[t.Data]
+			changed := false
+			for i, attr := range t.Attr {
+				switch {
+				case attr.Key == "style":
+					t.Attr[i].Val = string(rewriteCSS([]byte(attr.Val), base, mapping))
+					changed = true
+				case attr.Key == "srcset" && attrs != nil:
+					items := strings.Split(attr.Val, ",")
+					for j, item := range items {
+						fields := strings.Fields(item)
+						if len(fields) > 0 {
+							fields[0] = rewriteRef(base, fields[0], mapping)
+							items[j] = strings.Join(fields, " ")
+						}
+					}
+					t.Attr[i].Val = strings.Join(items, ", ")
+					changed = true
+				default:
+					if _, ok := attrs[attr.Key]; ok {
+						t.Attr[i].Val = rewriteRef(base, attr.Val, mapping)
+						changed = true
+					}
+				}
+			}
+			if changed {
+				buf.WriteString(t.String())
+			} else {
+				buf.Write(raw)
+			}
+			continue
+		}
+		buf.Write(z.Raw())
+	}
+}
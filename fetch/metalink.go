@@ -0,0 +1,196 @@
+package fetch
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+// File described in a Metalink document
+type MetalinkFile struct {
+	// relative path, it may contain directories
+	Name string
+	// -1 if unknown
+	Size int64
+	// sorted by priority, the most preferred first
+	URLs []string
+	// strongest whole file hash, nil if absent
+	Checksum *Checksum
+	// nil if absent
+	Pieces *Pieces
+}
+
+type metalinkHash struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type metalinkPieces struct {
+	Type   string         `xml:"type,attr"`
+	Length int64          `xml:"length,attr"`
+	Hashes []metalinkHash `xml:"hash"`
+}
+
+type metalinkURL struct {
+	// Metalink 4, 1 is the highest
+	Priority int `xml:"priority,attr"`
+	// Metalink 3, 100 is the highest
+	Preference int    `xml:"preference,attr"`
+	Value      string `xml:",chardata"`
+}
+
+// order of preferring hash algorithms
+var checksumStrength = map[string]int{
+	"md5":    1,
+	"sha1":   2,
+	"sha256": 3,
+	"sha512": 4,
+}
+
+// ParseMetalink parses Metalink 4 (.meta4) or Metalink 3 (.metalink) document,
+// URLs which are not HTTP or HTTPS and unsupported hashes are ignored
+func ParseMetalink(r io.Reader) ([]*MetalinkFile, error) {
+	bs, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	// Metalink 4 lists <file> under root, Metalink 3 under <files>
+	var doc4 struct {
+		Files []metalinkFileXML `xml:"file"`
+	}
+	var doc3 struct {
+		Files []metalinkFileXML `xml:"files>file"`
+	}
+	if err := xml.Unmarshal(bs, &doc4); err != nil {
+		return nil, fmt.Errorf("parse metalink: %w", err)
+	}
+	if err := xml.Unmarshal(bs, &doc3); err != nil {
+		return nil, fmt.Errorf("parse metalink: %w", err)
+	}
+	items := append(doc4.Files, doc3.Files...)
+	if len(items) == 0 {
+		return nil, errors.New("no file in metalink")
+	}
+	var files []*MetalinkFile
+	for _, item := range items {
+		file, err := item.toFile()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+type metalinkFileXML struct {
+	Name string `xml:"name,attr"`
+	Size string `xml:"size"`
+	// Metalink 4
+	Hashes []metalinkHash   `xml:"hash"`
+	Pieces []metalinkPieces `xml:"pieces"`
+	URLs   []metalinkURL    `xml:"url"`
+	// Metalink 3
+	Verification struct {
+		Hashes []metalinkHash   `xml:"hash"`
+		Pieces []metalinkPieces `xml:"pieces"`
+	} `xml:"verification"`
+	Resources struct {
+		URLs []metalinkURL `xml:"url"`
+	} `xml:"resources"`
+}
+
+func (item *metalinkFileXML) toFile() (*MetalinkFile, error) {
+	name := strings.TrimSpace(item.Name)
+	if name == "" {
+		return nil, errors.New("file without name in metalink")
+	}
+	file := &MetalinkFile{Name: name, Size: -1}
+	if size := strings.TrimSpace(item.Size); size != "" {
+		if _, err := fmt.Sscan(size, &file.Size); err != nil {
+			return nil, fmt.Errorf("invalid size %s of %s in metalink", size, name)
+		}
+	}
+	for _, h := range append(item.Hashes, item.Verification.Hashes...) {
+		checksum, err := NewChecksum(h.Type, h.Value)
+		if err != nil {
+			continue
+		}
+		if file.Checksum == nil || checksumStrength[checksum.Algorithm] > checksumStrength[file.Checksum.Algorithm] {
+			file.Checksum = checksum
+		}
+	}
+	for _, p := range append(item.Pieces, item.Verification.Pieces...) {
+		pieces, err := newPieces(p)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if pieces != nil && (file.Pieces == nil || checksumStrength[pieces.Algorithm] > checksumStrength[file.Pieces.Algorithm]) {
+			file.Pieces = pieces
+		}
+	}
+	type weighted struct {
+		url    string
+		weight int
+	}
+	var urls []weighted
+	for _, u := range append(item.URLs, item.Resources.URLs...) {
+		value := strings.TrimSpace(u.Value)
+		parsed, err := url.Parse(value)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			continue
+		}
+		// the lower weight, the more preferred, unspecified priority is the least preferred
+		weight := 1 << 30
+		if u.Priority > 0 {
+			weight = u.Priority
+		} else if u.Preference > 0 {
+			weight = 1 + 100 - u.Preference
+		}
+		urls = append(urls, weighted{value, weight})
+	}
+	sort.SliceStable(urls, func(i, j int) bool {
+		return urls[i].weight < urls[j].weight
+	})
+	for _, u := range urls {
+		file.URLs = append(file.URLs, u.url)
+	}
+	return file, nil
+}
+
+// nil if hash type is unsupported
+func newPieces(p metalinkPieces) (*Pieces, error) {
+	if p.Length <= 0 {
+		return nil, fmt.Errorf("invalid piece length %d", p.Length)
+	}
+	algorithm := strings.ReplaceAll(strings.ToLower(strings.TrimSpace(p.Type)), "-", "")
+	if _, err := newHash(algorithm); err != nil {
+		return nil, nil
+	}
+	pieces := &Pieces{Length: p.Length, Algorithm: algorithm}
+	for _, h := range p.Hashes {
+		checksum, err := NewChecksum(algorithm, h.Value)
+		if err != nil {
+			return nil, err
+		}
+		pieces.Hashes = append(pieces.Hashes, checksum)
+	}
+	if len(pieces.Hashes) == 0 {
+		return nil, nil
+	}
+	return pieces, nil
+}
+
+// SafeName returns cleaned relative path of name, error if it is absolute or escapes the directory
+func (file *MetalinkFile) SafeName() (string, error) {
+	name := strings.ReplaceAll(file.Name, `\`, "/")
+	cleaned := path.Clean(name)
+	if path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") || strings.Contains(cleaned, ":") {
+		return "", fmt.Errorf("unsafe file name %s in metalink", file.Name)
+	}
+	return cleaned, nil
+}
@@ -0,0 +1,142 @@
+package fetch
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// error returned by HookContext or a short read of it, or ErrContentChanged, it is not a fault of the mirror
+type hookError struct {
+	err error
+}
+
+func (e *hookError) Error() string {
+	return e.err.Error()
+}
+
+func (e *hookError) Unwrap() error {
+	return e.err
+}
+
+// return the original error of hook
+func unwrapHookError(err error) error {
+	var he *hookError
+	if errors.As(err, &he) {
+		return he.err
+	}
+	return err
+}
+
+// Inspect every URL of the same content, URLs failed to inspect are dropped and their errors are returned in failures.
+//
+// The rest must all support ranges and report the same length, and the same ETag if checkETag is true and more than
+// one of them has it, otherwise they are not regarded as mirrors of the same content. ETags of different servers
+// may differ even if the content is the same, so checkETag can be false if the content is verified by hash.
+// info is the inspection of the first usable URL.
+func (fetcher *Fetcher) InspectMirrors(urls []string, checkETag bool) (usable []string, info *Inspection, failures map[string]error, err error) {
+	if len(urls) == 0 {
+		return nil, nil, nil, errors.New("no URL")
+	}
+	type result struct {
+		info *Inspection
+		err  error
+	}
+	results := make([]result, len(urls))
+	var wg sync.WaitGroup
+	for i, url := range urls {
+		wg.Add(1)
+		go func(i int, url string) {
+			defer wg.Done()
+			results[i].info, results[i].err = fetcher.Inspect(url)
+		}(i, url)
+	}
+	wg.Wait()
+	failures = make(map[string]error)
+	var etagURL, etag string
+	for i, url := range urls {
+		r := results[i].info
+		if err := results[i].err; err != nil {
+			failures[url] = err
+			continue
+		}
+		if !r.Supported || r.Length < 0 {
+			failures[url] = errors.New("not support ranges")
+			continue
+		}
+		if info != nil && r.Length != info.Length {
+			return nil, nil, failures, fmt.Errorf("length %d of %s differs from length %d of %s", r.Length, url, info.Length, usable[0])
+		}
+		if checkETag && r.ETag != "" {
+			if etag != "" && normalizeETag(r.ETag) != normalizeETag(etag) {
+				return nil, nil, failures, fmt.Errorf("ETag %s of %s differs from ETag %s of %s", r.ETag, url, etag, etagURL)
+			}
+			etagURL, etag = url, r.ETag
+		}
+		if info == nil {
+			info = r
+		}
+		usable = append(usable, url)
+	}
+	if len(usable) == 0 {
+		err = errors.New("no usable mirror")
+		for _, url := range urls {
+			err = fmt.Errorf("%w, %s: %s", err, url, failures[url])
+		}
+		return nil, nil, failures, err
+	}
+	return usable, info, failures, nil
+}
+
+// weak and strong ETags of the same value are regarded as equal
+func normalizeETag(etag string) string {
+	return strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+}
+
+// healthy state of mirrors shared by connections
+type mirrorSet struct {
+	l      sync.Mutex
+	urls   []string
+	failed []bool
+	// called when a mirror is given up and other mirrors are left
+	onFail func(url string, err error)
+}
+
+func newMirrorSet(urls []string, onFail func(url string, err error)) *mirrorSet {
+	return &mirrorSet{
+		urls:   urls,
+		failed: make([]bool, len(urls)),
+		onFail: onFail,
+	}
+}
+
+// next healthy mirror from i, i itself included, false if all mirrors failed
+func (ms *mirrorSet) next(i int) (int, bool) {
+	ms.l.Lock()
+	defer ms.l.Unlock()
+	return ms.nextLocked(i)
+}
+
+func (ms *mirrorSet) nextLocked(i int) (int, bool) {
+	for j := 0; j < len(ms.urls); j++ {
+		k := (i + j) % len(ms.urls)
+		if !ms.failed[k] {
+			return k, true
+		}
+	}
+	return -1, false
+}
+
+// mark mirror i failed and return next healthy mirror, false if all mirrors failed
+func (ms *mirrorSet) fail(i int, err error) (int, bool) {
+	ms.l.Lock()
+	defer ms.l.Unlock()
+	first := !ms.failed[i]
+	ms.failed[i] = true
+	next, ok := ms.nextLocked(i + 1)
+	if first && ok && ms.onFail != nil {
+		ms.onFail(ms.urls[i], err)
+	}
+	return next, ok
+}
@@ -0,0 +1,104 @@
+package fetch
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// NetrcMachine is an entry of .netrc, Name is empty for the default entry
+type NetrcMachine struct {
+	Name     string
+	Login    string
+	Password string
+}
+
+// ParseNetrc parses machine and default entries of .netrc, macros are skipped
+func ParseNetrc(r io.Reader) ([]*NetrcMachine, error) {
+	var machines []*NetrcMachine
+	var current *NetrcMachine
+	scanner := bufio.NewScanner(r)
+	inMacro := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		// a macro definition ends with an empty line
+		if inMacro {
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+		if i := strings.Index(line, "#"); i > -1 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			next := func() string {
+				if i+1 < len(fields) {
+					i++
+					return fields[i]
+				}
+				return ""
+			}
+			switch fields[i] {
+			case "machine":
+				current = &NetrcMachine{Name: next()}
+				machines = append(machines, current)
+			case "default":
+				current = &NetrcMachine{}
+				machines = append(machines, current)
+			case "login":
+				if v := next(); current != nil {
+					current.Login = v
+				}
+			case "password":
+				if v := next(); current != nil {
+					current.Password = v
+				}
+			case "account":
+				next()
+			case "macdef":
+				inMacro = true
+				i = len(fields)
+			}
+		}
+	}
+	return machines, scanner.Err()
+}
+
+// LookupNetrc finds the machine of host in .netrc, which is $NETRC or ~/.netrc if name is empty,
+// the default entry is used if the host isn't listed, nil if not found
+func LookupNetrc(name string, host string) (*NetrcMachine, error) {
+	if name == "" {
+		if name = os.Getenv("NETRC"); name == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, nil
+			}
+			name = filepath.Join(home, ".netrc")
+		}
+	}
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	machines, err := ParseNetrc(f)
+	if err != nil {
+		return nil, err
+	}
+	var fallback *NetrcMachine
+	for _, m := range machines {
+		if m.Name == "" {
+			if fallback == nil {
+				fallback = m
+			}
+		} else if strings.EqualFold(m.Name, host) {
+			return m, nil
+		}
+	}
+	return fallback, nil
+}
@@ -0,0 +1,93 @@
+package fetch
+
+import (
+	"fmt"
+	"io"
+)
+
+// Hashes of fixed length pieces of a file, the last piece may be shorter
+type Pieces struct {
+	Length    int64
+	Algorithm string
+	Hashes    []*Checksum
+}
+
+// check whether pieces cover a body of length
+func (p *Pieces) check(length int64) error {
+	if n := (length + p.Length - 1) / p.Length; n != int64(len(p.Hashes)) {
+		return fmt.Errorf("%d piece hashes of length %d do not match body length %d", len(p.Hashes), p.Length, length)
+	}
+	return nil
+}
+
+// A piece does not match its hash, it is regarded as a fault of the server
+type PieceError struct {
+	Index int
+	Err   error
+}
+
+func (e *PieceError) Error() string {
+	return fmt.Sprintf("piece %d is corrupt: %s", e.Index, e.Err)
+}
+
+func (e *PieceError) Unwrap() error {
+	return e.Err
+}
+
+// pieceReader reads a whole piece into buffer and passes it on only if the piece is verified,
+// so a corrupt piece is never written, offset must be at the start of a piece
+type pieceReader struct {
+	r      io.Reader
+	pieces *Pieces
+	length int64
+	// offset of next byte read from r
+	offset int64
+	buf    []byte
+	rest   []byte
+}
+
+func newPieceReader(r io.Reader, pieces *Pieces, offset, length int64) *pieceReader {
+	return &pieceReader{
+		r:      r,
+		pieces: pieces,
+		length: length,
+		offset: offset,
+	}
+}
+
+func (pr *pieceReader) Read(p []byte) (int, error) {
+	if len(pr.rest) == 0 {
+		if pr.offset >= pr.length {
+			return 0, io.EOF
+		}
+		if pr.offset%pr.pieces.Length != 0 {
+			return 0, fmt.Errorf("offset %d is not at the start of a piece", pr.offset)
+		}
+		index := int(pr.offset / pr.pieces.Length)
+		size := pr.pieces.Length
+		if pr.offset+size > pr.length {
+			size = pr.length - pr.offset
+		}
+		if int64(cap(pr.buf)) < size {
+			pr.buf = make([]byte, size)
+		}
+		buf := pr.buf[:size]
+		// an unfinished piece is dropped
+		if _, err := io.ReadFull(pr.r, buf); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		h := pr.pieces.Hashes[index].NewHash()
+		h.Write(buf)
+		if err := pr.pieces.Hashes[index].Verify(h.Sum(nil)); err != nil {
+			return 0, &PieceError{Index: index, Err: err}
+		}
+		pr.rest = buf
+		pr.offset += size
+	}
+	n := copy(p, pr.rest)
+	pr.rest = pr.rest[n:]
+	return n, nil
+}
@@ -0,0 +1,184 @@
+package fetch
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// ReaderAtOption of Fetcher.NewReaderAt
+type ReaderAtOption struct {
+	// size of a range request, content is cached by blocks, default 256K
+	BlockSize int64
+	// maximum bytes of cached blocks, default 64M
+	CacheSize int64
+	// maximum blocks of a request when reading sequentially, default 16
+	Readahead int
+}
+
+// ReaderAt reads remote content by range requests, so that formats like zip can be read without downloading
+// the whole content. Blocks read are cached, and more blocks are requested at once while reading sequentially.
+// It is safe for concurrent use.
+type ReaderAt struct {
+	fetcher *Fetcher
+	url     string
+	size    int64
+	// sent as If-Range, so that a changed content is never mixed
+	ifRange   string
+	blockSize int64
+	maxBlocks int
+	readahead int
+	fetched   int64
+	requests  int64
+
+	l sync.Mutex
+	// most recently used in front
+	lru    *list.List
+	blocks map[int64]*list.Element
+	// block after the last request and blocks of the next request
+	next    int64
+	nextLen int
+}
+
+type cachedBlock struct {
+	index int64
+	data  []byte
+}
+
+// NewReaderAt inspects url and returns ReaderAt of its content, the server must support ranges
+func (fetcher *Fetcher) NewReaderAt(url string, option *ReaderAtOption) (*ReaderAt, error) {
+	if option == nil {
+		option = &ReaderAtOption{}
+	}
+	info, err := fetcher.Inspect(url)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Supported || info.Length < 0 {
+		return nil, fmt.Errorf("%s doesn't support range requests", url)
+	}
+	r := &ReaderAt{
+		fetcher:   fetcher,
+		url:       info.URL,
+		size:      info.Length,
+		ifRange:   ValidatorsOf(info).IfRange(),
+		blockSize: option.BlockSize,
+		readahead: option.Readahead,
+		lru:       list.New(),
+		blocks:    make(map[int64]*list.Element),
+		next:      -1,
+	}
+	if r.blockSize <= 0 {
+		r.blockSize = 256 * 1024
+	}
+	if r.readahead <= 0 {
+		r.readahead = 16
+	}
+	cacheSize := option.CacheSize
+	if cacheSize <= 0 {
+		cacheSize = 64 * 1024 * 1024
+	}
+	r.maxBlocks = int(cacheSize / r.blockSize)
+	// blocks of a request are always kept until they are read
+	if r.maxBlocks < r.readahead {
+		r.maxBlocks = r.readahead
+	}
+	return r, nil
+}
+
+// Size of the content
+func (r *ReaderAt) Size() int64 {
+	return r.size
+}
+
+// Fetched returns bytes received by range requests
+func (r *ReaderAt) Fetched() int64 {
+	return atomic.LoadInt64(&r.fetched)
+}
+
+// Requests returns count of range requests sent
+func (r *ReaderAt) Requests() int64 {
+	return atomic.LoadInt64(&r.requests)
+}
+
+func (r *ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= r.size {
+			return n, io.EOF
+		}
+		block, err := r.block(pos / r.blockSize)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], block[pos%r.blockSize:])
+	}
+	return n, nil
+}
+
+// get block of index from cache, or request it together with following blocks if reading sequentially
+func (r *ReaderAt) block(index int64) ([]byte, error) {
+	r.l.Lock()
+	if e, ok := r.blocks[index]; ok {
+		r.lru.MoveToFront(e)
+		r.l.Unlock()
+		return e.Value.(*cachedBlock).data, nil
+	}
+	count := 1
+	if index == r.next {
+		count = r.nextLen
+	}
+	// stop before a cached block, it needn't be requested again
+	for i := 1; i < count; i++ {
+		if _, ok := r.blocks[index+int64(i)]; ok || (index+int64(i))*r.blockSize >= r.size {
+			count = i
+			break
+		}
+	}
+	r.next = index + int64(count)
+	r.nextLen = count * 2
+	if r.nextLen > r.readahead {
+		r.nextLen = r.readahead
+	}
+	r.l.Unlock()
+
+	start := index * r.blockSize
+	length := int64(count) * r.blockSize
+	if start+length > r.size {
+		length = r.size - start
+	}
+	atomic.AddInt64(&r.requests, 1)
+	data, err := r.fetcher.getWithRetry(context.Background(), r.url, start, length, r.ifRange)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&r.fetched, int64(len(data)))
+
+	r.l.Lock()
+	defer r.l.Unlock()
+	for i := 0; i < count; i++ {
+		end := int64(i+1) * r.blockSize
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		b := &cachedBlock{index: index + int64(i), data: data[int64(i)*r.blockSize : end]}
+		if e, ok := r.blocks[b.index]; ok {
+			r.lru.Remove(e)
+		}
+		r.blocks[b.index] = r.lru.PushFront(b)
+	}
+	for r.lru.Len() > r.maxBlocks {
+		e := r.lru.Back()
+		r.lru.Remove(e)
+		delete(r.blocks, e.Value.(*cachedBlock).index)
+	}
+	return data[:min(r.blockSize, int64(len(data)))], nil
+}
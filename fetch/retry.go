@@ -0,0 +1,164 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Exponential backoff with full jitter
+type Backoff struct {
+	// delay of first retry, default 500ms
+	Base time.Duration
+	// maximum delay of backoff, default 30s
+	Max time.Duration
+	// longest Retry-After to wait, default 10m, retrying stops if the server asks to wait longer
+	MaxRetryAfter time.Duration
+}
+
+func (b Backoff) withDefault() Backoff {
+	if b.Base <= 0 {
+		b.Base = time.Millisecond * 500
+	}
+	if b.Max <= 0 {
+		b.Max = time.Second * 30
+	}
+	if b.Max < b.Base {
+		b.Max = b.Base
+	}
+	if b.MaxRetryAfter <= 0 {
+		b.MaxRetryAfter = time.Minute * 10
+	}
+	return b
+}
+
+// Delay returns how long to wait before retry, attempt starts from 0,
+// if retryAfter is greater than 0, it is waited in full instead of backoff
+func (b Backoff) Delay(attempt int, retryAfter time.Duration) time.Duration {
+	b = b.withDefault()
+	if retryAfter > 0 {
+		return retryAfter
+	}
+	d := b.Base
+	for i := 0; i < attempt && d < b.Max; i++ {
+		d *= 2
+	}
+	if d > b.Max {
+		d = b.Max
+	}
+	// full jitter, but not less than half of base
+	return min(b.Base/2+time.Duration(rand.Int63n(int64(d))), b.Max)
+}
+
+// Response status is 429 or 503, the request should be retried later
+type RetryableStatusError struct {
+	Status string
+	// parsed from Retry-After header, 0 if absent
+	RetryAfter time.Duration
+}
+
+func (e *RetryableStatusError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("unexpected status \"%s\", retry after %s", e.Status, e.RetryAfter)
+	}
+	return fmt.Sprintf("unexpected status \"%s\"", e.Status)
+}
+
+// parse Retry-After in seconds or HTTP date
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// if status is 429 or 503, close body and return *RetryableStatusError
+func checkRetryableStatus(resp *http.Response) error {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return nil
+	}
+	resp.Body.Close()
+	return &RetryableStatusError{
+		Status:     resp.Status,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+}
+
+func retryAfterOf(err error) time.Duration {
+	var statusErr *RetryableStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.RetryAfter
+	}
+	return 0
+}
+
+// whether the request was not sent, so even a non-idempotent request can be retried
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// wait before next attempt, return false if context is done or Retry-After is longer than MaxRetryAfter
+func (fetcher *Fetcher) waitRetry(ctx context.Context, attempt int, err error) bool {
+	retryAfter := retryAfterOf(err)
+	if retryAfter > fetcher.backoff.MaxRetryAfter {
+		return false
+	}
+	return sleepContext(ctx, fetcher.backoff.Delay(attempt, retryAfter)) == nil
+}
+
+// Send request via Fetcher.Do and retry with backoff, newRequest is called for every attempt.
+//
+// 429 and 503 responses are always retried, Retry-After is honoured unless it is longer than MaxRetryAfter of
+// Backoff, then the error is returned without retrying. Network errors are retried only
+// if the method is idempotent or the request was not sent. The last response is returned if all attempts failed.
+func (fetcher *Fetcher) DoWithRetry(newRequest func() (*http.Request, error)) (*http.Response, error) {
+	for j := 0; ; j++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := fetcher.Do(req)
+		last := j >= fetcher.try-1
+		if err != nil {
+			idempotent := req.Method == http.MethodGet || req.Method == http.MethodHead
+			if last || req.Context().Err() != nil || (!idempotent && !isDialError(err)) {
+				return nil, err
+			}
+		} else if last || resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+			return resp, nil
+		} else {
+			err = checkRetryableStatus(resp)
+		}
+		if !fetcher.waitRetry(req.Context(), j, err) {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package fetch
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"strings"
+)
+
+type robotsRule struct {
+	allow   bool
+	pattern *regexp.Regexp
+	// length of original path, the longest matched rule wins
+	length int
+}
+
+// Rules of robots.txt for one user agent, nil allows everything
+type robotsRules struct {
+	rules []robotsRule
+}
+
+// convert path pattern with "*" and "$" into regexp
+func robotsPattern(p string) *regexp.Regexp {
+	anchored := strings.HasSuffix(p, "$")
+	p = strings.TrimSuffix(p, "$")
+	parts := strings.Split(p, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	expr := "^" + strings.Join(parts, ".*")
+	if anchored {
+		expr += "$"
+	}
+	return regexp.MustCompile(expr)
+}
+
+// parse robots.txt and keep the group of agent, or the group of "*" if agent is not listed
+func parseRobots(r io.Reader, agent string) *robotsRules {
+	agent = strings.ToLower(agent)
+	type group struct {
+		agents []string
+		rules  []robotsRule
+	}
+	var groups []*group
+	var current *group
+	// consecutive user-agent lines share one group
+	lastIsAgent := false
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i > -1 {
+			line = line[:i]
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		switch key {
+		case "user-agent":
+			if !lastIsAgent || current == nil {
+				current = &group{}
+				groups = append(groups, current)
+			}
+			current.agents = append(current.agents, strings.ToLower(value))
+			lastIsAgent = true
+		case "allow", "disallow":
+			lastIsAgent = false
+			// empty disallow allows everything
+			if current == nil || value == "" {
+				continue
+			}
+			current.rules = append(current.rules, robotsRule{
+				allow:   key == "allow",
+				pattern: robotsPattern(value),
+				length:  len(value),
+			})
+		default:
+			lastIsAgent = false
+		}
+	}
+	var wildcard *group
+	for _, g := range groups {
+		for _, a := range g.agents {
+			if a == "*" {
+				if wildcard == nil {
+					wildcard = g
+				}
+			} else if a != "" && strings.Contains(agent, a) {
+				return &robotsRules{rules: g.rules}
+			}
+		}
+	}
+	if wildcard != nil {
+		return &robotsRules{rules: wildcard.rules}
+	}
+	return nil
+}
+
+// path includes query, allow wins if an allow rule and a disallow rule are of the same length
+func (rr *robotsRules) allowed(path string) bool {
+	if rr == nil {
+		return true
+	}
+	allowed, length := true, -1
+	for _, rule := range rr.rules {
+		if !rule.pattern.MatchString(path) {
+			continue
+		}
+		if rule.length > length || (rule.length == length && rule.allow) {
+			allowed, length = rule.allow, rule.length
+		}
+	}
+	return allowed
+}
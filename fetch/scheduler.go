@@ -0,0 +1,313 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultChunkSizeMin int64 = 256 * 1024
+	defaultChunkSizeMax int64 = 16 * 1024 * 1024
+)
+
+// a range of body assigned to one connection, end may be reduced when the rest is stolen
+type chunk struct {
+	index int
+	start int64
+	// guarded by rangeScheduler.l
+	pos int64
+	// bytes before reserved may be in reading, a split point must not be less than it
+	reserved int64
+	end      int64
+	begin    time.Time
+}
+
+// issues chunks of body to workers, the remaining range of a slow chunk is split for idle workers
+type rangeScheduler struct {
+	l           sync.Cond
+	length      int64
+	next        int64
+	index       int
+	active      map[*chunk]struct{}
+	min         int64
+	max         int64
+	concurrency int
+	// number of workers allowed to take work, only changed by adaptive concurrency
+	limit int
+	// total read bytes, for measuring throughput
+	readN int64
+	// start of every chunk is a multiple of align, 1 means no alignment
+	align int64
+}
+
+// align is piece length when pieces are verified, chunk sizes are rounded up to multiples of it
+func newRangeScheduler(length int64, concurrency int, min, max int64, align int64) *rangeScheduler {
+	if min <= 0 {
+		min = defaultChunkSizeMin
+	}
+	if max <= 0 {
+		max = defaultChunkSizeMax
+	}
+	if align <= 0 {
+		align = 1
+	}
+	min = roundUp(min, align)
+	max = roundUp(max, align)
+	if max < min {
+		max = min
+	}
+	return &rangeScheduler{
+		align:       align,
+		l:           sync.Cond{L: &sync.Mutex{}},
+		length:      length,
+		active:      make(map[*chunk]struct{}),
+		min:         min,
+		max:         max,
+		concurrency: concurrency,
+		limit:       concurrency,
+	}
+}
+
+// chunk size shrinks as the unassigned part gets smaller, so that the tail is shared by more workers
+func (s *rangeScheduler) chunkSize() int64 {
+	size := (s.length - s.next) / int64(s.concurrency*2)
+	if size < s.min {
+		size = s.min
+	}
+	if size > s.max {
+		size = s.max
+	}
+	return roundUp(size, s.align)
+}
+
+func roundUp(n, align int64) int64 {
+	return (n + align - 1) / align * align
+}
+
+func (s *rangeScheduler) finished() bool {
+	return s.next >= s.length && len(s.active) == 0
+}
+
+// acquire returns next chunk for worker id, it blocks while the worker is not allowed to work, nil means no more work
+func (s *rangeScheduler) acquire(ctx context.Context, id int) *chunk {
+	s.l.L.Lock()
+	defer s.l.L.Unlock()
+	for id >= s.limit && !s.finished() && ctx.Err() == nil {
+		s.l.Wait()
+	}
+	if ctx.Err() != nil || s.finished() {
+		return nil
+	}
+	if s.next < s.length {
+		end := s.next + s.chunkSize() - 1
+		// avoid leaving a tiny tail
+		if end >= s.length-1 || s.length-1-end < s.min {
+			end = s.length - 1
+		}
+		return s.add(s.next, end)
+	}
+	// steal from the chunk expected to finish last
+	var victim *chunk
+	var victimLeft time.Duration
+	now := time.Now()
+	for c := range s.active {
+		from := c.reserved
+		if c.pos > from {
+			from = c.pos
+		}
+		remaining := c.end - from + 1
+		if remaining < s.min*2 {
+			continue
+		}
+		var left time.Duration
+		if done := c.pos - c.start; done > 0 {
+			left = time.Duration(float64(now.Sub(c.begin)) * float64(remaining) / float64(done))
+		} else {
+			// no progress, it must be the slowest
+			left = time.Duration(1<<63 - 1)
+		}
+		if victim == nil || left > victimLeft {
+			victim, victimLeft = c, left
+		}
+	}
+	if victim == nil {
+		return nil
+	}
+	from := victim.reserved
+	if victim.pos > from {
+		from = victim.pos
+	}
+	mid := roundUp(from+(victim.end-from+1)/2, s.align)
+	if mid > victim.end {
+		return nil
+	}
+	end := victim.end
+	victim.end = mid - 1
+	return s.add(mid, end)
+}
+
+// must be called with lock held
+func (s *rangeScheduler) add(start, end int64) *chunk {
+	c := &chunk{
+		index:    s.index,
+		start:    start,
+		pos:      start,
+		reserved: start,
+		end:      end,
+		begin:    time.Now(),
+	}
+	s.index++
+	if end >= s.next {
+		s.next = end + 1
+	}
+	s.active[c] = struct{}{}
+	return c
+}
+
+func (s *rangeScheduler) release(c *chunk) {
+	s.l.L.Lock()
+	delete(s.active, c)
+	s.l.L.Unlock()
+	s.l.Broadcast()
+}
+
+// reserve returns how many bytes can be read into buffer of size n, 0 means the chunk is done
+func (s *rangeScheduler) reserve(c *chunk, n int) int {
+	s.l.L.Lock()
+	defer s.l.L.Unlock()
+	left := c.end - c.pos + 1
+	if left < int64(n) {
+		n = int(left)
+	}
+	if n < 0 {
+		n = 0
+	}
+	c.reserved = c.pos + int64(n)
+	return n
+}
+
+func (s *rangeScheduler) advance(c *chunk, n int) {
+	s.l.L.Lock()
+	c.pos += int64(n)
+	c.reserved = c.pos
+	s.l.L.Unlock()
+	atomic.AddInt64(&s.readN, int64(n))
+}
+
+// remaining returns [pos, end] of chunk
+func (s *rangeScheduler) remaining(c *chunk) (pos, end int64) {
+	s.l.L.Lock()
+	defer s.l.L.Unlock()
+	return c.pos, c.end
+}
+
+func (s *rangeScheduler) setLimit(limit int) {
+	s.l.L.Lock()
+	s.limit = limit
+	s.l.L.Unlock()
+	s.l.Broadcast()
+}
+
+// wake up waiting workers, called when context is done
+func (s *rangeScheduler) wake() {
+	s.l.L.Lock()
+	s.l.L.Unlock()
+	s.l.Broadcast()
+}
+
+// adapt grows or shrinks the number of working connections by measured throughput until ctx is done
+func (s *rangeScheduler) adapt(ctx context.Context, interval time.Duration) {
+	limit := s.concurrency / 2
+	if limit < 1 {
+		limit = 1
+	}
+	s.setLimit(limit)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var lastRate float64
+	lastN := atomic.LoadInt64(&s.readN)
+	lastTime := time.Now()
+	step := 1
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n := atomic.LoadInt64(&s.readN)
+			rate := float64(n-lastN) / now.Sub(lastTime).Seconds()
+			lastN, lastTime = n, now
+			// keep direction while throughput improves, turn back when it drops
+			if lastRate > 0 && rate < lastRate*0.95 {
+				step = -step
+			} else if lastRate > 0 && rate < lastRate*1.05 {
+				lastRate = rate
+				continue
+			}
+			lastRate = rate
+			limit += step
+			if limit < 1 {
+				limit, step = 1, 1
+			}
+			if limit > s.concurrency {
+				limit, step = s.concurrency, -1
+			}
+			s.setLimit(limit)
+		}
+	}
+}
+
+// chunkReader reads body of a chunk and stops at the current end of the chunk
+type chunkReader struct {
+	s *rangeScheduler
+	c *chunk
+	r io.Reader
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	n := cr.s.reserve(cr.c, len(p))
+	if n == 0 {
+		return 0, io.EOF
+	}
+	n, err := cr.r.Read(p[:n])
+	if n > 0 {
+		cr.s.advance(cr.c, n)
+	}
+	if err == io.EOF {
+		if pos, end := cr.s.remaining(cr.c); pos <= end {
+			err = io.ErrUnexpectedEOF
+			if br, ok := cr.r.(*bodyReader); ok {
+				br.err = err
+			}
+		}
+	}
+	return n, err
+}
+
+// check whether the whole chunk has been read
+func (cr *chunkReader) check() error {
+	pos, end := cr.s.remaining(cr.c)
+	if pos != end+1 {
+		return fmt.Errorf("index: %d, start: %d, end: %d, read count %d not equal %d", cr.c.index, cr.c.start, end, pos-cr.c.start, end-cr.c.start+1)
+	}
+	return nil
+}
+
+// bodyReader records read count and error of response body, to tell network errors from errors of hook
+type bodyReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (br *bodyReader) Read(p []byte) (int, error) {
+	n, err := br.r.Read(p)
+	br.n += int64(n)
+	if err != nil && err != io.EOF {
+		br.err = err
+	}
+	return n, err
+}
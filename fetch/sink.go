@@ -0,0 +1,237 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// Sink is the target of a download, ranges are written at their offsets by several goroutines concurrently,
+// a byte is never written twice
+type Sink interface {
+	io.WriterAt
+	io.Closer
+}
+
+// Truncater is implemented by sinks whose size can be set after download, the size may be unknown before
+type Truncater interface {
+	Truncate(size int64) error
+}
+
+// Preallocator is implemented by sinks which reserve space before the first write if the length is known
+type Preallocator interface {
+	Preallocate(size int64) error
+}
+
+// a sink which may block in writing, it must return when ctx is done
+type contextWriterAt interface {
+	writeAtContext(ctx context.Context, p []byte, off int64) (int, error)
+}
+
+// FileSink writes to a file, disk space is reserved before download where it is supported
+type FileSink struct {
+	*os.File
+}
+
+func NewFileSink(name string, perm ...fs.FileMode) (*FileSink, error) {
+	if len(perm) == 0 {
+		perm = append(perm, 0666)
+	}
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY, perm[0])
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{File: f}, nil
+}
+
+// Preallocate reserves size bytes, so a full disk fails the download at the beginning and the file is less fragmented,
+// it does nothing if the file system doesn't support it
+func (f *FileSink) Preallocate(size int64) error {
+	return fallocate(f.File, size)
+}
+
+// MemorySink keeps the content in memory
+type MemorySink struct {
+	l   sync.Mutex
+	buf []byte
+}
+
+func NewMemorySink() *MemorySink {
+	return &MemorySink{}
+}
+
+func (m *MemorySink) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	m.l.Lock()
+	defer m.l.Unlock()
+	if end := off + int64(len(p)); end > int64(len(m.buf)) {
+		if end > int64(cap(m.buf)) {
+			buf := make([]byte, end, end*5/4)
+			copy(buf, m.buf)
+			m.buf = buf
+		} else {
+			m.buf = m.buf[:end]
+		}
+	}
+	copy(m.buf[off:], p)
+	return len(p), nil
+}
+
+func (m *MemorySink) Preallocate(size int64) error {
+	m.l.Lock()
+	defer m.l.Unlock()
+	if size > int64(cap(m.buf)) {
+		buf := make([]byte, len(m.buf), size)
+		copy(buf, m.buf)
+		m.buf = buf
+	}
+	return nil
+}
+
+func (m *MemorySink) Truncate(size int64) error {
+	m.l.Lock()
+	defer m.l.Unlock()
+	if size <= int64(len(m.buf)) {
+		m.buf = m.buf[:size]
+		return nil
+	}
+	buf := make([]byte, size)
+	copy(buf, m.buf)
+	m.buf = buf
+	return nil
+}
+
+// Bytes returns the content, it must not be modified
+func (m *MemorySink) Bytes() []byte {
+	m.l.Lock()
+	defer m.l.Unlock()
+	return m.buf
+}
+
+func (m *MemorySink) Close() error {
+	return nil
+}
+
+// StreamSink writes the content to an io.Writer in order, ranges ahead of the written part are buffered,
+// writers of them wait if the buffer is full, the range at the written part is never blocked so it can't deadlock
+type StreamSink struct {
+	w     io.Writer
+	limit int64
+	l     sync.Mutex
+	// broadcast when the written part grows or the sink is closed
+	cond *sync.Cond
+	// length of the part written to w
+	next int64
+	// buffered ranges by offset
+	pending  map[int64][]byte
+	buffered int64
+	err      error
+	closed   bool
+}
+
+// limit is the maximum bytes buffered, default 64MB
+func NewStreamSink(w io.Writer, limit int64) *StreamSink {
+	if limit <= 0 {
+		limit = 64 * 1024 * 1024
+	}
+	s := &StreamSink{w: w, limit: limit, pending: make(map[int64][]byte)}
+	s.cond = sync.NewCond(&s.l)
+	return s
+}
+
+func (s *StreamSink) WriteAt(p []byte, off int64) (int, error) {
+	return s.writeAtContext(context.Background(), p, off)
+}
+
+func (s *StreamSink) writeAtContext(ctx context.Context, p []byte, off int64) (int, error) {
+	stop := context.AfterFunc(ctx, func() {
+		s.l.Lock()
+		s.cond.Broadcast()
+		s.l.Unlock()
+	})
+	defer stop()
+	s.l.Lock()
+	defer s.l.Unlock()
+	for {
+		if s.err != nil {
+			return 0, s.err
+		}
+		if s.closed {
+			return 0, os.ErrClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		if off < s.next {
+			return 0, fmt.Errorf("offset %d has been written", off)
+		}
+		if off == s.next || s.buffered == 0 || s.buffered+int64(len(p)) <= s.limit {
+			break
+		}
+		s.cond.Wait()
+	}
+	if off > s.next {
+		s.pending[off] = append([]byte{}, p...)
+		s.buffered += int64(len(p))
+		return len(p), nil
+	}
+	if err := s.flush(p); err != nil {
+		return 0, err
+	}
+	for {
+		bs, ok := s.pending[s.next]
+		if !ok {
+			break
+		}
+		delete(s.pending, s.next)
+		s.buffered -= int64(len(bs))
+		if err := s.flush(bs); err != nil {
+			return 0, err
+		}
+	}
+	s.cond.Broadcast()
+	return len(p), nil
+}
+
+// write p at next, it is called with lock held, so writes to w are in order
+func (s *StreamSink) flush(p []byte) error {
+	if _, err := s.w.Write(p); err != nil {
+		s.err = err
+		s.cond.Broadcast()
+		return err
+	}
+	s.next += int64(len(p))
+	return nil
+}
+
+// Written returns length of the part written to the underlying writer
+func (s *StreamSink) Written() int64 {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.next
+}
+
+// Truncate checks that the whole content of size has been written, a stream can't be truncated
+func (s *StreamSink) Truncate(size int64) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.next != size || s.buffered > 0 {
+		return fmt.Errorf("%d of %d bytes written to stream, %d bytes are not in order", s.next, size, s.buffered)
+	}
+	return nil
+}
+
+// Close wakes up waiting writers, the underlying writer is not closed
+func (s *StreamSink) Close() error {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.closed = true
+	s.cond.Broadcast()
+	return nil
+}
@@ -0,0 +1,83 @@
+package fetch
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// returned by DownloadWithManual if the response of a range request with If-Range is the whole content
+var ErrContentChanged = errors.New("remote content changed during download")
+
+// Validators of a downloaded content, they are sent as conditions so that an unchanged content isn't downloaded again
+type Validators struct {
+	ETag         string    `json:"etag,omitempty"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+func ValidatorsOf(info *Inspection) *Validators {
+	return &Validators{ETag: info.ETag, LastModified: info.LastModified}
+}
+
+// whether there is no validator
+func (v *Validators) Empty() bool {
+	return v.ETag == "" && v.LastModified.IsZero()
+}
+
+// set If-None-Match and If-Modified-Since, the latter is ignored by servers if the former is present
+func (v *Validators) setConditions(header http.Header) {
+	if v.ETag != "" {
+		header.Set("If-None-Match", v.ETag)
+	}
+	if !v.LastModified.IsZero() {
+		header.Set("If-Modified-Since", v.LastModified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// IfRange returns value for DownloadOption.IfRange, a strong ETag is preferred,
+// a weak ETag can't be used in If-Range, empty if there is no usable validator
+func (v *Validators) IfRange() string {
+	if v.ETag != "" && !strings.HasPrefix(v.ETag, "W/") {
+		return v.ETag
+	}
+	if !v.LastModified.IsZero() {
+		return v.LastModified.UTC().Format(http.TimeFormat)
+	}
+	return ""
+}
+
+// validators of file are kept in a sidecar file next to it
+func validatorsFile(file string) string {
+	return file + ".validators"
+}
+
+// LoadValidators reads validators of file saved by SaveValidators
+func LoadValidators(file string) (*Validators, error) {
+	bs, err := os.ReadFile(validatorsFile(file))
+	if err != nil {
+		return nil, err
+	}
+	v := &Validators{}
+	if err := json.Unmarshal(bs, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// SaveValidators keeps v of file in the sidecar file, the sidecar file is removed if v is empty
+func SaveValidators(file string, v *Validators) error {
+	if v.Empty() {
+		if err := os.Remove(validatorsFile(file)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(validatorsFile(file), bs, 0644)
+}
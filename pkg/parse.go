@@ -5,7 +5,10 @@ import (
 	"fmt"
 	"net/url"
 	"path"
+	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 func ParseFileNameByURLPath(p string) (string, error) {
@@ -20,6 +23,51 @@ func ParseFileNameByURLPath(p string) (string, error) {
 	return name, nil
 }
 
+// device names reserved by Windows
+var reservedFileNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// Make a file name given by remote safe to be created in the current directory:
+// directories are dropped, control and reserved characters are replaced by "_",
+// leading dots are removed so that hidden files aren't created, and it is limited to 255 bytes with extension kept
+func SanitizeFileName(name string) (string, error) {
+	name = strings.ReplaceAll(name, `\`, "/")
+	name = name[strings.LastIndex(name, "/")+1:]
+	name = strings.Map(func(r rune) rune {
+		if r == utf8.RuneError || unicode.IsControl(r) || strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	// Windows ignores trailing dots and spaces
+	name = strings.TrimRight(name, ". ")
+	if name == "" {
+		return "", errors.New("unable to sanitize file name")
+	}
+	base := strings.ToUpper(strings.SplitN(name, ".", 2)[0])
+	if reservedFileNames[base] {
+		name = "_" + name
+	}
+	const maxLength = 255
+	if len(name) > maxLength {
+		ext := path.Ext(name)
+		if len(ext) > maxLength/2 {
+			ext = ""
+		}
+		stem := name[:maxLength-len(ext)]
+		// don't cut a multibyte character
+		for !utf8.ValidString(stem) {
+			stem = stem[:len(stem)-1]
+		}
+		name = stem + ext
+	}
+	return name, nil
+}
+
 // Parse URL as much as possible, scheme are optional, defaults are http and https
 func ParseURL(s string, scheme ...string) (*url.URL, error) {
 	if len(scheme) <= 0 {
@@ -52,3 +100,31 @@ func ParseURL(s string, scheme ...string) (*url.URL, error) {
 	}
 	return nil, fmt.Errorf("unsupported scheme: %s", u.Scheme)
 }
+
+// Parse size such as 512, 16K, 1.5M, 2G, 1MB and 1MiB, units are powers of 1024
+func ParseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "IB"), "B")
+	if s == "" {
+		return 0, errors.New("empty size")
+	}
+	unit := int64(1)
+	switch s[len(s)-1] {
+	case 'K':
+		unit = 1024
+	case 'M':
+		unit = 1024 * 1024
+	case 'G':
+		unit = 1024 * 1024 * 1024
+	case 'T':
+		unit = 1024 * 1024 * 1024 * 1024
+	}
+	if unit > 1 {
+		s = s[:len(s)-1]
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+	return int64(v * float64(unit)), nil
+}
@@ -0,0 +1,165 @@
+package pkg
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Token bucket shared by goroutines, nil means unlimited
+type RateLimiter struct {
+	l sync.Mutex
+	// bytes per second
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// if bytesPerSecond <= 0, return nil
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	rate := float64(bytesPerSecond)
+	return &RateLimiter{
+		rate:   rate,
+		burst:  rate / 4,
+		tokens: rate / 4,
+		last:   time.Now(),
+	}
+}
+
+func (rl *RateLimiter) Rate() int64 {
+	if rl == nil {
+		return 0
+	}
+	return int64(rl.rate)
+}
+
+// max bytes should be read or written at once, so that waiting is smooth
+func (rl *RateLimiter) chunk() int {
+	c := int(rl.rate / 10)
+	if c < 1024 {
+		c = 1024
+	}
+	if c > 32*1024 {
+		c = 32 * 1024
+	}
+	return c
+}
+
+// take n tokens, if tokens are not enough, wait until they are paid back
+func (rl *RateLimiter) WaitN(ctx context.Context, n int) error {
+	if rl == nil || n <= 0 {
+		return nil
+	}
+	rl.l.Lock()
+	now := time.Now()
+	rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+	if rl.tokens > rl.burst {
+		rl.tokens = rl.burst
+	}
+	rl.last = now
+	rl.tokens -= float64(n)
+	var wait time.Duration
+	if rl.tokens < 0 {
+		wait = time.Duration(-rl.tokens / rl.rate * float64(time.Second))
+	}
+	rl.l.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// smallest chunk of limiters, 0 if all limiters are nil
+func chunkOf(limiters []*RateLimiter) int {
+	c := 0
+	for _, rl := range limiters {
+		if rl != nil && (c == 0 || rl.chunk() < c) {
+			c = rl.chunk()
+		}
+	}
+	return c
+}
+
+func waitAll(ctx context.Context, limiters []*RateLimiter, n int) error {
+	for _, rl := range limiters {
+		if err := rl.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type rateLimitedReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*RateLimiter
+	chunk    int
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > r.chunk {
+		p = p[:r.chunk]
+	}
+	n, err := r.r.Read(p)
+	if waitErr := waitAll(r.ctx, r.limiters, n); waitErr != nil && err == nil {
+		err = waitErr
+	}
+	return n, err
+}
+
+// Reader limited by all limiters, if all limiters are nil, r is returned
+func NewRateLimitedReader(ctx context.Context, r io.Reader, limiters ...*RateLimiter) io.Reader {
+	chunk := chunkOf(limiters)
+	if chunk == 0 {
+		return r
+	}
+	return &rateLimitedReader{ctx: ctx, r: r, limiters: limiters, chunk: chunk}
+}
+
+type rateLimitedWriter struct {
+	ctx      context.Context
+	w        io.Writer
+	limiters []*RateLimiter
+	chunk    int
+}
+
+func (w *rateLimitedWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		b := p
+		if len(b) > w.chunk {
+			b = b[:w.chunk]
+		}
+		if err := waitAll(w.ctx, w.limiters, len(b)); err != nil {
+			return written, err
+		}
+		n, err := w.w.Write(b)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Writer limited by all limiters, if all limiters are nil, w is returned
+func NewRateLimitedWriter(ctx context.Context, w io.Writer, limiters ...*RateLimiter) io.Writer {
+	chunk := chunkOf(limiters)
+	if chunk == 0 {
+		return w
+	}
+	return &rateLimitedWriter{ctx: ctx, w: w, limiters: limiters, chunk: chunk}
+}
@@ -135,11 +135,9 @@ func (c *Client) Ping() (time.Duration, error) {
 }
 
 func (c *Client) List(cb func(info *FileInfo)) error {
-	req, err := http.NewRequest(http.MethodGet, c.GetListURL(), nil)
-	if err != nil {
-		return err
-	}
-	resp, err := c.fetcher.Do(req)
+	resp, err := c.fetcher.DoWithRetry(func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, c.GetListURL(), nil)
+	})
 	if err != nil {
 		return err
 	}
@@ -159,11 +157,9 @@ func (c *Client) List(cb func(info *FileInfo)) error {
 }
 
 func (c *Client) Delete(remoteFile string) error {
-	req, err := http.NewRequest(http.MethodDelete, c.GetDeleteFileURL(remoteFile), nil)
-	if err != nil {
-		return err
-	}
-	resp, err := c.fetcher.Do(req)
+	resp, err := c.fetcher.DoWithRetry(func() (*http.Request, error) {
+		return http.NewRequest(http.MethodDelete, c.GetDeleteFileURL(remoteFile), nil)
+	})
 	if err != nil {
 		return err
 	}
@@ -175,11 +171,9 @@ func (c *Client) Delete(remoteFile string) error {
 }
 
 func (c *Client) Move(remoteFile, newRemoteFile string, overwrite bool) error {
-	req, err := http.NewRequest(http.MethodPost, c.GetMoveFileURL(remoteFile, newRemoteFile, overwrite), nil)
-	if err != nil {
-		return err
-	}
-	resp, err := c.fetcher.Do(req)
+	resp, err := c.fetcher.DoWithRetry(func() (*http.Request, error) {
+		return http.NewRequest(http.MethodPost, c.GetMoveFileURL(remoteFile, newRemoteFile, overwrite), nil)
+	})
 	if err != nil {
 		return err
 	}
@@ -191,11 +185,9 @@ func (c *Client) Move(remoteFile, newRemoteFile string, overwrite bool) error {
 }
 
 func (c *Client) ensureExistFile(remoteFile string) error {
-	req, err := http.NewRequest(http.MethodGet, c.GetDownloadFileURL(remoteFile), nil)
-	if err != nil {
-		return err
-	}
-	resp, err := c.fetcher.Do(req)
+	resp, err := c.fetcher.DoWithRetry(func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, c.GetDownloadFileURL(remoteFile), nil)
+	})
 	if err != nil {
 		return err
 	}
@@ -216,17 +208,40 @@ func (c *Client) Get(concurrency int, remoteFile string, localFile string, hook
 	if err := c.ensureExistFile(remoteFile); err != nil {
 		return err
 	}
-	fw, err := fetch.NewFileWriter(localFile)
+	sink, err := fetch.NewFileSink(localFile)
 	if err != nil {
 		return err
 	}
+	return c.download(concurrency, remoteFile, sink, hook)
+}
+
+// GetTo downloads remote file to sink, it is closed after download
+func (c *Client) GetTo(concurrency int, remoteFile string, sink fetch.Sink, hook func(beforeDownload bool, supported bool, length int64, n int)) error {
+	if err := c.ensureExistFile(remoteFile); err != nil {
+		sink.Close()
+		return err
+	}
+	return c.download(concurrency, remoteFile, sink, hook)
+}
+
+// OpenReaderAt returns ReaderAt of remote file, only ranges read from it are downloaded
+func (c *Client) OpenReaderAt(remoteFile string, option *fetch.ReaderAtOption) (*fetch.ReaderAt, error) {
+	if err := c.ensureExistFile(remoteFile); err != nil {
+		return nil, err
+	}
+	return c.fetcher.NewReaderAt(c.GetDownloadFileURL(remoteFile), option)
+}
+
+func (c *Client) download(concurrency int, remoteFile string, sink fetch.Sink, hook func(beforeDownload bool, supported bool, length int64, n int)) error {
+	fw := fetch.NewWriter(sink)
 	defer fw.Close()
 
 	fileURL := c.GetDownloadFileURL(remoteFile)
-	supported, length, err := c.fetcher.Inspect(fileURL)
+	info, err := c.fetcher.Inspect(fileURL)
 	if err != nil {
 		return err
 	}
+	supported, length := info.Supported, info.Length
 	hook(true, supported, length, 0)
 	fw.OnWrite(func(n, index int, start, end, length int64) {
 		hook(false, supported, length, n)
@@ -235,7 +250,9 @@ func (c *Client) Get(concurrency int, remoteFile string, localFile string, hook
 		Concurrency: concurrency,
 		HookContext: fw.HookContext,
 	})
-	fw.Truncate(fw.WrittenN())
+	if truncateErr := fw.Truncate(fw.WrittenN()); err == nil {
+		err = truncateErr
+	}
 	return err
 }
 
@@ -271,12 +288,9 @@ func (c *Client) Put(concurrency int, overwrite bool, localFile string, remoteFi
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequest(http.MethodPost, c.GetUploadFileURL(remoteFile), bytes.NewReader(bs))
-	if err != nil {
-		return err
-	}
-
-	if resp, err := c.fetcher.Do(req); err != nil {
+	if resp, err := c.fetcher.DoWithRetry(func() (*http.Request, error) {
+		return http.NewRequest(http.MethodPost, c.GetUploadFileURL(remoteFile), bytes.NewReader(bs))
+	}); err != nil {
 		return err
 	} else {
 		if err := checkRespReturnErr(resp); err != nil {
@@ -320,13 +334,14 @@ func (c *Client) Put(concurrency int, overwrite bool, localFile string, remoteFi
 				abort(err)
 				return
 			}
-			req, err := http.NewRequestWithContext(ctx, http.MethodPut, uploadURL, io.LimitReader(&fileOffsetReader{
+			// limiter of fetcher is shared by all slices
+			req, err := http.NewRequestWithContext(ctx, http.MethodPut, uploadURL, pkg.NewRateLimitedReader(ctx, io.LimitReader(&fileOffsetReader{
 				f:      f,
 				offset: offset,
 				onRead: func(n int) {
 					hook(false, *uploadInfo, n)
 				},
-			}, size))
+			}, size), c.fetcher.RateLimiter()))
 
 			if err != nil {
 				abort(err)
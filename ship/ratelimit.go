@@ -0,0 +1,101 @@
+package ship
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"spaceship/pkg"
+)
+
+type clientLimiter struct {
+	limiter  *pkg.RateLimiter
+	lastUsed time.Time
+}
+
+// rate limiters keyed by client IP, idle limiters are removed
+type clientLimiters struct {
+	rate      int64
+	l         *sync.Mutex
+	m         map[string]*clientLimiter
+	lastClean time.Time
+}
+
+// if rate <= 0, return nil
+func newClientLimiters(rate int64) *clientLimiters {
+	if rate <= 0 {
+		return nil
+	}
+	return &clientLimiters{
+		rate:      rate,
+		l:         &sync.Mutex{},
+		m:         make(map[string]*clientLimiter),
+		lastClean: time.Now(),
+	}
+}
+
+func (cl *clientLimiters) get(r *http.Request) *pkg.RateLimiter {
+	if cl == nil {
+		return nil
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	cl.l.Lock()
+	defer cl.l.Unlock()
+	now := time.Now()
+	if now.Sub(cl.lastClean) > time.Minute {
+		for k, v := range cl.m {
+			if now.Sub(v.lastUsed) > time.Minute {
+				delete(cl.m, k)
+			}
+		}
+		cl.lastClean = now
+	}
+	v, ok := cl.m[ip]
+	if !ok {
+		v = &clientLimiter{limiter: pkg.NewRateLimiter(cl.rate)}
+		cl.m[ip] = v
+	}
+	v.lastUsed = now
+	return v.limiter
+}
+
+type rateLimitedResponseWriter struct {
+	http.ResponseWriter
+	w io.Writer
+}
+
+func (w *rateLimitedResponseWriter) Write(p []byte) (int, error) {
+	return w.w.Write(p)
+}
+
+func (srv *Service) limitResponseWriter(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	limiter := srv.limiters.get(r)
+	if srv.limiter == nil && limiter == nil {
+		return w
+	}
+	return &rateLimitedResponseWriter{
+		ResponseWriter: w,
+		w:              pkg.NewRateLimitedWriter(r.Context(), w, srv.limiter, limiter),
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func (srv *Service) limitRequestBody(r *http.Request) io.ReadCloser {
+	limiter := srv.limiters.get(r)
+	if srv.limiter == nil && limiter == nil {
+		return r.Body
+	}
+	return readCloser{
+		Reader: pkg.NewRateLimitedReader(r.Context(), r.Body, srv.limiter, limiter),
+		Closer: r.Body,
+	}
+}
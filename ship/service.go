@@ -26,6 +26,10 @@ type ServiceOption struct {
 	URLPathPrefix string
 	// default "./"
 	Root string
+	// bytes per second of downloads and uploads of all clients, 0 means unlimited
+	LimitRate int64
+	// bytes per second of downloads and uploads of each client (by remote IP), 0 means unlimited
+	LimitRatePerClient int64
 }
 
 type Service struct {
@@ -34,10 +38,14 @@ type Service struct {
 	prefix string
 	root   string
 	tasks  *taskSet
+	// nil means unlimited
+	limiter  *pkg.RateLimiter
+	limiters *clientLimiters
 }
 
 func (srv *Service) onUpload(absPath, relPath string, w http.ResponseWriter, r *http.Request) {
 	defer srv.tasks.clean()
+	r.Body = srv.limitRequestBody(r)
 	if r.Method == http.MethodPost {
 		var info UploadInfo
 		deocder := json.NewDecoder(r.Body)
@@ -132,7 +140,7 @@ func (srv *Service) onDownload(absPath, relPath string, w http.ResponseWriter, r
 	req := r.Clone(r.Context())
 	req.URL.Path = "/file"
 	writeStatusHeader(w, true)
-	http.ServeFile(w, req, absPath)
+	http.ServeFile(srv.limitResponseWriter(w, r), req, absPath)
 }
 func (srv *Service) onList(absPath, relPath string, w http.ResponseWriter) {
 	exist, isDir, err := checkPath(absPath)
@@ -280,7 +288,8 @@ func (srv *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	absPath := filepath.Join(srv.root, relPath)
-	if filepath.Dir(absPath) != srv.root {
+	// root itself is allowed for listing
+	if absPath != srv.root && filepath.Dir(absPath) != srv.root {
 		writeBadError(w, fmt.Sprintf("Path %s out of bounds", relPath))
 		return
 	}
@@ -350,9 +359,11 @@ func NewService(option ServiceOption) *Service {
 		option.Root = "."
 	}
 	srv := &Service{
-		prefix: option.URLPathPrefix,
-		root:   filepath.Clean(option.Root),
-		tasks:  newTaskSet(),
+		prefix:   option.URLPathPrefix,
+		root:     filepath.Clean(option.Root),
+		tasks:    newTaskSet(),
+		limiter:  pkg.NewRateLimiter(option.LimitRate),
+		limiters: newClientLimiters(option.LimitRatePerClient),
 	}
 	srv.SetAuth(option.Auth)
 	return srv